@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/config"
+	"github.com/sepich/containerd-registry-cache/pkg/migrate"
+	"github.com/sepich/containerd-registry-cache/pkg/ocilayout"
+	"github.com/spf13/pflag"
+)
+
+// command is a maintenance subcommand, run instead of the server
+type command struct {
+	usage string
+	run   func(args []string) int
+}
+
+var commands = map[string]command{
+	"export":  {"Export images (all cached when none given) to OCI image-layout tar: export -o images.tar [registry/repository[:tag|@digest]...]", exportCmd},
+	"migrate": {"Copy all the cached objects to another backend, resumable: migrate -d /data --to-bucket my-bucket", migrateCmd},
+	"import":  {"Import OCI image-layout tar, verifying digests and skipping existing objects: import -i images.tar", importCmd},
+}
+
+func init() {
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n%s", os.Args[0], pflag.CommandLine.FlagUsages())
+		fmt.Fprintf(os.Stderr, "\nCommands (see `<command> -h`):\n")
+		for _, name := range slices.Sorted(maps.Keys(commands)) {
+			fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].usage)
+		}
+	}
+}
+
+// commandFlags returns flags of cache storage and logging, common for commands
+func commandFlags(name string) (*pflag.FlagSet, *config.Storage, func() *slog.Logger) {
+	fs := pflag.NewFlagSet(name, pflag.ExitOnError)
+	s := &config.Storage{}
+	fs.StringVarP(&s.CacheDir, "cache-dir", "d", "/tmp/data", "Cache directory")
+	fs.StringVarP(&s.Bucket, "bucket", "b", "", "Use S3 bucket for cache")
+	fs.StringVarP(&s.Metadata, "file-metadata", "", "sidecar", "Metadata of objects in cache dir: sidecar or xattr")
+	logLevel := fs.StringP("log-level", "l", "info", "Log level to use (debug, info)")
+	// output could go to stdout
+	return fs, s, func() *slog.Logger { return getLogger(os.Stderr, *logLevel, "text") }
+}
+
+func exportCmd(args []string) int {
+	fs, storage, logger := commandFlags("export")
+	output := fs.StringP("output", "o", "-", "Archive `file` to write, - for stdout")
+	fs.Parse(args)
+	l := logger()
+
+	c, err := newCache(*storage, l)
+	if err != nil {
+		l.Error("Could not open cache", "error", err)
+		return 1
+	}
+	store, ok := c.(cache.Store)
+	if !ok {
+		l.Error("Cache backend does not support export")
+		return 1
+	}
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			l.Error("Could not create archive", "error", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	stats, err := ocilayout.Export(ctx, store, w, fs.Args(), l)
+	if err != nil {
+		l.Error("Export failed", "error", err)
+		if *output != "-" {
+			os.Remove(*output)
+		}
+		return 1
+	}
+	l.Info("Exported", "images", stats.Images, "manifests", stats.Manifests, "blobs", stats.Blobs, "bytes", stats.Bytes, "missing", stats.Missing)
+	return 0
+}
+
+func importCmd(args []string) int {
+	fs, storage, logger := commandFlags("import")
+	input := fs.StringP("input", "i", "", "Archive `file` to read, uncompressed tar")
+	repository := fs.StringP("repository", "", "", "Import images without name annotation (by other tools) to `registry/repository`, by their tags")
+	fs.Parse(args)
+	l := logger()
+	if *input == "" {
+		l.Error("Archive file should be set via --input")
+		return 1
+	}
+
+	// for temp files of downloads in S3 mode too
+	if err := os.MkdirAll(storage.CacheDir, os.ModePerm); err != nil {
+		l.Error("Could not create cache directory", "error", err)
+		return 1
+	}
+	c, err := newCache(*storage, l)
+	if err != nil {
+		l.Error("Could not open cache", "error", err)
+		return 1
+	}
+	f, err := os.Open(*input)
+	if err != nil {
+		l.Error("Could not open archive", "error", err)
+		return 1
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		l.Error("Could not open archive", "error", err)
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	stats, err := ocilayout.Import(ctx, c, f, info.Size(), *repository, l)
+	if err != nil {
+		l.Error("Import failed", "error", err)
+		return 1
+	}
+	l.Info("Imported", "images", stats.Images, "manifests", stats.Manifests, "blobs", stats.Blobs, "bytes", stats.Bytes, "skipped", stats.Skipped, "missing", stats.Missing)
+	return 0
+}
+
+func migrateCmd(args []string) int {
+	fs, storage, logger := commandFlags("migrate")
+	to := config.Storage{}
+	fs.StringVarP(&to.CacheDir, "to-cache-dir", "", "/tmp/data", "Destination cache directory, or for temp files of --to-bucket")
+	fs.StringVarP(&to.Bucket, "to-bucket", "", "", "Destination S3 bucket")
+	fs.StringVarP(&to.Metadata, "to-file-metadata", "", "sidecar", "Metadata of objects in destination cache dir: sidecar or xattr")
+	workers := fs.IntP("workers", "w", 8, "Objects to copy in parallel")
+	verify := fs.BoolP("verify", "", true, "Read objects back from destination after copy to verify them (content is verified against digest while copying regardless)")
+	fs.Parse(args)
+	l := logger()
+	if to.Bucket == storage.Bucket && (to.Bucket != "" || to.CacheDir == storage.CacheDir) {
+		l.Error("Destination should differ from source, set --to-cache-dir or --to-bucket")
+		return 1
+	}
+
+	src, err := newCache(*storage, l)
+	if err != nil {
+		l.Error("Could not open source cache", "error", err)
+		return 1
+	}
+	store, ok := src.(cache.Store)
+	if !ok {
+		l.Error("Source cache backend does not support listing")
+		return 1
+	}
+	if err := os.MkdirAll(to.CacheDir, os.ModePerm); err != nil {
+		l.Error("Could not create cache directory", "error", err)
+		return 1
+	}
+	dst, err := newCache(to, l)
+	if err != nil {
+		l.Error("Could not open destination cache", "error", err)
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	m := &migrate.Migrator{Src: store, Dst: dst, Workers: *workers, Verify: *verify, Logger: l}
+	stats, err := m.Run(ctx)
+	if err != nil {
+		l.Error("Migration failed, run it again to resume", "error", err, "copied", stats.Copied, "bytes", stats.Bytes)
+		return 1
+	}
+	l.Info("Migrated", "objects", stats.Objects, "copied", stats.Copied, "skipped", stats.Skipped, "bytes", stats.Bytes,
+		"corrupt", stats.Corrupt, "orphans", stats.Orphans, "errors", stats.Errors)
+	if stats.Errors != 0 {
+		return 1
+	}
+	return 0
+}
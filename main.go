@@ -1,33 +1,89 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"net/http"
 	"net/http/pprof"
 	"os"
-	"regexp"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/prometheus/common/version"
+	"github.com/sepich/containerd-registry-cache/pkg/accesslog"
+	"github.com/sepich/containerd-registry-cache/pkg/admin"
+	"github.com/sepich/containerd-registry-cache/pkg/auth"
 	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/config"
+	"github.com/sepich/containerd-registry-cache/pkg/gc"
 	"github.com/sepich/containerd-registry-cache/pkg/mux"
+	"github.com/sepich/containerd-registry-cache/pkg/scrub"
+	"github.com/sepich/containerd-registry-cache/pkg/server"
 	"github.com/sepich/containerd-registry-cache/pkg/service"
+	"github.com/sepich/containerd-registry-cache/pkg/tracing"
+	"github.com/sepich/containerd-registry-cache/pkg/upstream"
+	"github.com/sepich/containerd-registry-cache/pkg/usage"
 	"github.com/spf13/pflag"
-	"gopkg.in/yaml.v3"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+	var configFile = pflag.StringP("config", "c", "", "Use yaml config file, overriding flags. Reloaded on change or SIGHUP")
 	var cacheDir = pflag.StringP("cache-dir", "d", "/tmp/data", "Cache directory")
 	var bucket = pflag.StringP("bucket", "b", "", "Use S3 bucket for cache")
-	var credsFile = pflag.StringP("creds-file", "f", "", "Use credentials file for registry auth")
+	var fileMetadata = pflag.StringP("file-metadata", "", "sidecar", "Keep metadata of cached objects in .json sidecar files, or in xattr of data files (existing sidecars are migrated): sidecar, xattr")
+	var credsFiles = pflag.StringArrayP("creds-file", "f", []string{}, "Use credentials file (yaml or dockerconfigjson) for registry auth. Reloaded on change or SIGHUP (can be specified multiple times)")
 	var port = pflag.IntP("port", "p", 3000, "Port to listen on")
+	var tlsPort = pflag.IntP("tls-port", "", 0, "Port to listen on with TLS and HTTP/2, 0 to disable")
+	var tlsCert = pflag.StringP("tls-cert", "", "", "TLS certificate file, reloaded on change")
+	var tlsKey = pflag.StringP("tls-key", "", "", "TLS key file, reloaded on change")
+	var tlsClientCA = pflag.StringP("tls-client-ca", "", "", "CA file to verify client certificates if given, for `auth` clientCerts rules")
 	var skipTags = pflag.StringP("skip-tags", "t", "latest", "RegEx of image tags to skip caching")
 	var cacheManifests = pflag.BoolP("cache-manifests", "m", true, "Enable manifests cache")
+	var manifestTTL = pflag.DurationP("manifest-ttl", "", 0, "Refetch cached manifests by tag older than this, 0 to keep forever")
 	var privReg = pflag.StringArrayP("private-registry", "", []string{}, "Private registry to skip Manifest caching for (can be specified multiple times)")
+	var rewrites = pflag.StringArrayP("rewrite", "r", []string{}, "Rewrite registry/repo prefix `from=to[,fallback...]` to fetch it from mirrors (can be specified multiple times)")
+	var failThreshold = pflag.IntP("upstream-failures", "", 3, "Consecutive upstream failures (errors, 429, 5xx) to skip it for cooldown, 0 to disable")
+	var failCooldown = pflag.DurationP("upstream-cooldown", "", 30*time.Second, "Duration to skip failing upstream for")
+	var retries = pflag.IntP("upstream-retries", "", 3, "Attempts to resume interrupted blob download from upstream via Range request")
+	var retryBackoff = pflag.DurationP("upstream-retry-backoff", "", time.Second, "Initial delay between resume attempts, doubled on each one")
+	var rateLimits = pflag.StringArrayP("rate-limit", "", []string{}, "Rate limit requests to upstream `host=rps[:burst]`, use `*` host for all (can be specified multiple times)")
+	var rateLimitPerCreds = pflag.BoolP("rate-limit-per-creds", "", false, "Separate rate limit for each credentials key of upstream")
+	var rateLimitWait = pflag.DurationP("rate-limit-wait", "", 10*time.Second, "Max time to wait for upstream rate limit before responding 429, 0 to not wait")
+	var serveStale = pflag.BoolP("serve-stale", "", false, "Save skipped manifests (except private) to serve them when upstream is rate limited")
+	var fillTimeout = pflag.DurationP("fill-timeout", "", 0, "Let cache fill of a miss finish in background within this timeout after client disconnects, 0 to cancel with the client")
+	var verifyMaxKB = pflag.IntP("verify-max-kb", "", 0, "Verify digest of cached manifests and blobs up to this size (KB) before serving, corrupt ones are evicted and fetched from upstream, 0 to disable")
+	var ecrAuth = pflag.BoolP("ecr-auth", "", false, "Authenticate to ECR registries via AWS default credentials chain (IRSA)")
+	var ecrRoles = pflag.StringArrayP("ecr-role", "", []string{}, "Role to assume for ECR account `account=roleArn` (can be specified multiple times)")
+	var readyMinFree = pflag.IntP("ready-min-free-mb", "", 100, "Fail readiness when cache dir has less free space (MB)")
+	var readyUpstreams = pflag.StringArrayP("ready-upstream", "", []string{}, "Report in readiness whether canary upstream host is reachable, without failing it (can be specified multiple times)")
+	var shutdownDelay = pflag.DurationP("shutdown-delay", "", 0, "Time to keep serving after failing readiness on SIGTERM, for endpoints to be updated")
+	var shutdownGrace = pflag.DurationP("shutdown-grace", "", 25*time.Second, "Max time to wait for in-flight requests and cache fills on shutdown")
+	var usageIndex = pflag.BoolP("usage-index", "", false, "Record usage of cached objects, for admin API queries and GC last access")
+	var usageFlush = pflag.DurationP("usage-flush-interval", "", time.Minute, "Interval to save usage index to the cache")
+	var gcInterval = pflag.DurationP("gc-interval", "", 24*time.Hour, "Interval of garbage collection runs, 0 to disable scheduled runs")
+	var gcRetention = pflag.DurationP("gc-retention", "", 0, "Delete manifests and unreferenced blobs not accessed (or without --usage-index, not modified) for this, 0 to disable garbage collection")
+	var gcDryRun = pflag.BoolP("gc-dry-run", "", false, "Only report objects to be deleted by scheduled garbage collection")
+	var scrubInterval = pflag.DurationP("scrub-interval", "", 0, "Interval of integrity checks of all cached objects, 0 to disable")
+	var scrubRate = pflag.IntP("scrub-rate-mb", "", 10, "Read rate limit of integrity checks (MB/s), 0 for unlimited")
+	var scrubDelete = pflag.BoolP("scrub-delete", "", false, "Delete corrupt objects found by integrity checks instead of quarantine")
+	var metricsRepository = pflag.BoolP("metrics-repository", "", false, "Add repository label to metrics (limited to first 100 repositories)")
+	var otlpEndpoint = pflag.StringP("otlp-endpoint", "", "", "Export traces via OTLP/HTTP to `http://collector:4318`, empty to disable")
+	var traceRatio = pflag.Float64P("trace-sample-ratio", "", 1, "Ratio of new traces to sample, incoming sampled `traceparent` is always followed")
 	var logLevel = pflag.StringP("log-level", "l", "info", "Log level to use (debug, info)")
+	var logFormat = pflag.StringP("log-format", "", "text", "Log format to use (text, json)")
+	var accessLog = pflag.BoolP("access-log", "", true, "Log each request at info level with transfer stats")
 	var ver = pflag.BoolP("version", "v", false, "Show version and exit")
 	pflag.Parse()
 	if *ver {
@@ -35,52 +91,184 @@ func main() {
 		os.Exit(0)
 	}
 
-	logger := getLogger(*logLevel)
+	logger := getLogger(os.Stdout, *logLevel, *logFormat)
+	reloader := &config.Reloader{
+		ConfigFile: *configFile,
+		CredsFiles: *credsFiles,
+		Logger:     logger,
+		Base: func() *config.Config {
+			cfg := &config.Config{
+				Storage: config.Storage{CacheDir: *cacheDir, Bucket: *bucket, Metadata: *fileMetadata},
+				Policy: config.Policy{
+					SkipTags:       *skipTags,
+					CacheManifests: *cacheManifests,
+					ManifestTTL:    *manifestTTL,
+					ServeStale:     *serveStale,
+					FillTimeout:    *fillTimeout,
+					VerifyMaxKB:    *verifyMaxKB,
+				},
+				Upstream: config.Upstream{
+					Failures:          *failThreshold,
+					Cooldown:          *failCooldown,
+					Retries:           *retries,
+					RetryBackoff:      *retryBackoff,
+					RateLimitWait:     *rateLimitWait,
+					RateLimitPerCreds: *rateLimitPerCreds,
+				},
+			}
+			cfg.Metrics.Repository = *metricsRepository
+			cfg.GC = config.GC{Interval: *gcInterval, Retention: *gcRetention, DryRun: *gcDryRun}
+			cfg.Scrub = config.Scrub{Interval: *scrubInterval, RateMB: *scrubRate, Delete: *scrubDelete}
+			cfg.ECR.Enabled = *ecrAuth
+			for _, s := range *ecrRoles {
+				account, role, _ := strings.Cut(s, "=")
+				if cfg.ECR.Roles == nil {
+					cfg.ECR.Roles = map[string]string{}
+				}
+				cfg.ECR.Roles[account] = role
+			}
+			for _, name := range *privReg {
+				r := cfg.Registry(name)
+				r.Private = true
+				cfg.Registries[name] = r
+			}
+			for _, s := range *rewrites {
+				rule, err := upstream.ParseRule(s)
+				if err != nil {
+					logger.Error("Could not parse rewrite rule", "error", err)
+					os.Exit(1)
+				}
+				r := cfg.Registry(rule.Prefix)
+				r.Upstreams = rule.Targets
+				cfg.Registries[rule.Prefix] = r
+			}
+			for _, s := range *rateLimits {
+				limit, err := upstream.ParseLimit(s)
+				if err != nil {
+					logger.Error("Could not parse rate limit", "error", err)
+					os.Exit(1)
+				}
+				r := cfg.Registry(limit.Upstream)
+				r.RateLimit = &config.RateLimit{RPS: limit.RPS, Burst: limit.Burst}
+				cfg.Registries[limit.Upstream] = r
+			}
+			return cfg
+		},
+	}
+	cfg, err := reloader.Load()
+	if err != nil {
+		logger.Error("Could not load config", "error", err)
+		os.Exit(1)
+	}
+
 	host, _ := os.Hostname()
-	logger.Info("Starting containerd-registry-cache", "version", version.Version, "hostname", host, "port", *port, "cacheDir", *cacheDir)
-	logger.Debug("Debug logging active, headers will be logged and may include credentials")
+	logger.Info("Starting containerd-registry-cache", "version", version.Version, "hostname", host, "port", *port, "cacheDir", cfg.Storage.CacheDir)
+	logger.Debug("Debug logging active, headers will be logged (credentials are redacted)")
 
-	err := os.MkdirAll(*cacheDir, os.ModePerm)
+	err = os.MkdirAll(cfg.Storage.CacheDir, os.ModePerm)
 	if err != nil {
 		logger.Error("Could not create cache directory", "error", err)
 		os.Exit(1)
 	}
 
-	privateRegistries := make(map[string]bool)
-	for _, reg := range *privReg {
-		privateRegistries[reg] = true
+	if n, err := cache.SweepTempFiles(cfg.Storage.CacheDir, 10*time.Minute); err != nil {
+		logger.Warn("Could not remove orphaned temp files", "error", err)
+	} else if n != 0 {
+		logger.Info("Removed orphaned temp files", "count", n)
 	}
-	if len(privateRegistries) != 0 {
-		logger.Info("Private registry configured", "registries", len(*privReg))
+
+	c, err := newCache(cfg.Storage, logger)
+	if err != nil {
+		logger.Error("Could not start cache", "error", err)
+		os.Exit(1)
+	}
+	if fc, ok := c.(*cache.FileCache); ok && fc.Xattr {
+		go func() {
+			if n, err := fc.MigrateSidecars(context.Background()); err != nil {
+				logger.Error("Could not migrate metadata to xattrs", "error", err, "migrated", n)
+			} else if n != 0 {
+				logger.Info("Migrated metadata to xattrs", "count", n)
+			}
+		}()
 	}
 
-	var c cache.CachingService
-	if *bucket != "" {
-		logger.Info("Using S3 bucket for cache", "bucket", *bucket)
-		c, err = cache.NewS3Cache(*bucket, *cacheDir)
-		if err != nil {
-			logger.Error("Could not start S3 cache", "error", err)
-			os.Exit(1)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	shutdownTracing, err := tracing.Setup(ctx, *otlpEndpoint, *traceRatio)
+	if err != nil {
+		logger.Error("Could not configure tracing", "error", err)
+		os.Exit(1)
+	}
+	srv := &server.Server{Delay: *shutdownDelay, GracePeriod: *shutdownGrace, Logger: logger}
+	srv.Checks = append(srv.Checks, server.Check{Name: "cacheDir", Check: func(ctx context.Context) error {
+		return cache.CheckDir(cfg.Storage.CacheDir, uint64(*readyMinFree)<<20)
+	}})
+	if s3, ok := c.(*cache.S3Cache); ok {
+		srv.Checks = append(srv.Checks, server.Check{Name: "s3", Check: s3.Check})
+	}
+	for _, host := range *readyUpstreams {
+		srv.Checks = append(srv.Checks, server.Check{Name: "upstream:" + host, Informational: true, Check: func(ctx context.Context) error {
+			return service.PingUpstream(ctx, host)
+		}})
+	}
+
+	var idx *usage.Index
+	var collector *gc.Collector
+	var scrubber *scrub.Scrubber
+	if store, ok := c.(cache.Store); ok {
+		if *usageIndex {
+			idx = usage.New(store, host, logger)
+			go idx.Run(ctx, *usageFlush)
 		}
-	} else {
-		c = &cache.FileCache{CacheDirectory: *cacheDir}
+		collector = &gc.Collector{Store: store, Usage: idx, Replica: host, Logger: logger}
+		scrubber = &scrub.Scrubber{Store: store, Usage: idx, Replica: host, Logger: logger}
 	}
 
-	router := mux.NewRouter(&service.CacheService{
-		Cache:             c,
-		SkipTags:          regexp.MustCompile(*skipTags),
-		DefaultCreds:      readCreds(*credsFile, logger),
-		CacheManifests:    *cacheManifests,
-		PrivateRegistries: privateRegistries,
-	}, logger)
+	svc := &service.ReloadableService{}
+	authz := &auth.Reloadable{}
+	reloader.Apply = func(newCfg *config.Config) {
+		if newCfg.Storage != cfg.Storage {
+			logger.Warn("Storage config changed, restart is required to apply it", "storage", newCfg.Storage)
+		}
+		s := newService(newCfg, c, idx, svc.Load(), srv.Stopping(), logger)
+		s.AccessLog = *accessLog
+		svc.Store(s)
+		rules, _ := auth.New(newCfg.Auth) // already validated
+		if len(newCfg.Auth) != 0 {
+			logger.Info("Client auth configured", "rules", len(newCfg.Auth))
+		}
+		authz.Store(rules)
+		if collector != nil {
+			if idx == nil && newCfg.GC.Retention > 0 {
+				logger.Warn("GC uses modification time without --usage-index, objects are deleted after retention even if pulled meanwhile", "retention", newCfg.GC.Retention)
+			}
+			collector.SetPolicy(gc.Policy{Interval: newCfg.GC.Interval, Retention: newCfg.GC.Retention, Registries: newCfg.Retentions(), DryRun: newCfg.GC.DryRun})
+			scrubber.SetPolicy(scrub.Policy{Interval: newCfg.Scrub.Interval, Rate: int64(newCfg.Scrub.RateMB) << 20, Delete: newCfg.Scrub.Delete})
+		}
+	}
+	reloader.Init(cfg)
+	if *configFile != "" || len(*credsFiles) != 0 {
+		go reloader.Watch(ctx, 10*time.Second)
+	}
+	if collector != nil {
+		go collector.Run(ctx)
+		go scrubber.Run(ctx)
+	}
+
+	router := mux.NewRouter(svc, authz, logger)
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		logRequest(logger, r)
 		router.ServeHTTP(w, r)
 	}
 
+	var root http.Handler = http.HandlerFunc(handler)
+	if *accessLog {
+		root = accesslog.Handler(logger, root)
+	}
+
 	go func() {
 		pprofPort := *port + 1
-		logger.Info("Starting pprof server", "port", pprofPort)
+		logger.Info("Starting pprof and admin server", "port", pprofPort)
 
 		pprofMux := http.NewServeMux()
 		pprofMux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -88,6 +276,7 @@ func main() {
 		pprofMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 		pprofMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 		pprofMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		(&admin.Admin{Usage: idx, GC: collector, Scrub: scrubber, Stopping: ctx, Logger: logger}).Register(pprofMux)
 
 		// only kubectl port-forward
 		err := http.ListenAndServe("127.0.0.1:"+strconv.Itoa(pprofPort), pprofMux)
@@ -96,11 +285,34 @@ func main() {
 		}
 	}()
 
-	err = http.ListenAndServe(":"+strconv.Itoa(*port), http.HandlerFunc(handler))
-	if err != nil {
+	srv.Servers = append(srv.Servers, &http.Server{Addr: ":" + strconv.Itoa(*port), Handler: srv.Handler(root)})
+	if *tlsPort != 0 {
+		certs := &server.TLSReloader{CertFile: *tlsCert, KeyFile: *tlsKey, ClientCAFile: *tlsClientCA, Logger: logger}
+		if err := certs.Load(); err != nil {
+			logger.Error("Could not load TLS certificate", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Starting https server", "port", *tlsPort)
+		srv.Servers = append(srv.Servers, &http.Server{Addr: ":" + strconv.Itoa(*tlsPort), Handler: srv.Handler(root), TLSConfig: certs.Config()})
+	}
+
+	if err = srv.Run(ctx); err != nil {
 		logger.Error("Could not start http server", "error", err)
 		os.Exit(1)
 	}
+	if n := cache.RemoveTempFiles(); n != 0 {
+		logger.Info("Removed temp files of cancelled downloads", "count", n)
+	}
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if idx != nil {
+		if err := idx.Flush(flushCtx); err != nil {
+			logger.Warn("Could not save usage index", "error", err)
+		}
+	}
+	if err := shutdownTracing(flushCtx); err != nil {
+		logger.Warn("Could not flush traces", "error", err)
+	}
 }
 
 func logRequest(logger *slog.Logger, r *http.Request) {
@@ -116,15 +328,15 @@ func logRequest(logger *slog.Logger, r *http.Request) {
 	if i := strings.LastIndex(r.RemoteAddr, ":"); i != -1 {
 		ip = r.RemoteAddr[:i]
 	}
-	logger.Debug("Client request", "method", r.Method, "host", r.Host, "uri", r.RequestURI, "headers", r.Header, "addr", ip, "request_id", id)
+	logger.Debug("Client request", "method", r.Method, "host", r.Host, "uri", r.RequestURI, "headers", accesslog.Redact(r.Header), "addr", ip, "request_id", id)
 }
 
-func getLogger(logLevel string) *slog.Logger {
+func getLogger(w io.Writer, logLevel, logFormat string) *slog.Logger {
 	var l = slog.LevelInfo
 	if logLevel == "debug" {
 		l = slog.LevelDebug
 	}
-	return slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	opts := &slog.HandlerOptions{
 		Level:     l,
 		AddSource: logLevel == "debug",
 		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
@@ -142,30 +354,86 @@ func getLogger(logLevel string) *slog.Logger {
 			}
 			return a
 		},
-	}))
+	}
+	if logFormat == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
 }
 
-func readCreds(credsFile string, logger *slog.Logger) map[string]service.RegistryCreds {
-	res := map[string]service.RegistryCreds{}
-	if credsFile != "" {
-		data, err := os.ReadFile(credsFile)
-		if err != nil {
-			logger.Error("Could not read registry credentials file", "error", err)
-			os.Exit(1)
+// newCache returns S3Cache when bucket is set, FileCache otherwise
+func newCache(s config.Storage, logger *slog.Logger) (cache.CachingService, error) {
+	if s.Bucket != "" {
+		logger.Info("Using S3 bucket for cache", "bucket", s.Bucket)
+		return cache.NewS3Cache(context.Background(), s.Bucket, s.CacheDir)
+	}
+	c := &cache.FileCache{CacheDirectory: s.CacheDir, Xattr: s.Metadata == "xattr"}
+	if c.Xattr {
+		if err := c.CheckXattr(); err != nil {
+			return nil, err
 		}
+	}
+	return c, nil
+}
 
-		err = yaml.Unmarshal(data, &res)
-		if err != nil {
-			logger.Error("Could not parse registry credentials file", "error", err)
-			os.Exit(1)
-		}
-		for k, v := range res {
-			if v.Username == "" || v.Password == "" {
-				logger.Error("Registry credentials file contains invalid credentials", "registry", k)
-				os.Exit(1)
+// newService creates CacheService from config, reusing stateful parts of the previous one if their config is the same
+func newService(cfg *config.Config, c cache.CachingService, idx *usage.Index, prev *service.CacheService, stopping context.Context, logger *slog.Logger) *service.CacheService {
+	// already validated
+	skipTags, _ := cfg.SkipTagsRegexp()
+	upstreams, _ := cfg.Rewriter()
+	for _, rule := range upstreams.Rules() {
+		logger.Debug("Rewrite rule configured", "prefix", rule.Prefix, "upstreams", rule.Targets)
+	}
+	privateRegistries := cfg.PrivateRegistries()
+	if len(privateRegistries) != 0 {
+		logger.Info("Private registry configured", "registries", len(privateRegistries))
+	}
+	if len(cfg.Credentials) != 0 {
+		logger.Info("Loaded registry credentials", "registries", len(cfg.Credentials))
+	}
+
+	health := upstream.NewHealth(cfg.Upstream.Failures, cfg.Upstream.Cooldown)
+	if prev != nil && prev.Health.Threshold == health.Threshold && prev.Health.Cooldown == health.Cooldown {
+		health = prev.Health
+	}
+	var ecrAuth *service.ECRAuth
+	if cfg.ECR.Enabled {
+		if prev != nil && prev.ECR != nil && maps.Equal(prev.ECR.Roles, cfg.ECR.Roles) {
+			ecrAuth = prev.ECR
+		} else if a, err := service.NewECRAuth(context.Background(), cfg.ECR.Roles); err != nil {
+			logger.Error("Could not configure ECR auth", "error", err)
+			if prev != nil {
+				ecrAuth = prev.ECR
 			}
+		} else {
+			logger.Info("ECR auth enabled", "roles", len(cfg.ECR.Roles))
+			ecrAuth = a
 		}
-		logger.Info("Loaded registry credentials", "registries", len(res))
 	}
-	return res
+	limiter := upstream.NewRateLimiter(cfg.Limits(), cfg.Upstream.RateLimitPerCreds, cfg.Upstream.RateLimitWait)
+	if prev != nil && prev.RateLimiter.Equal(limiter) {
+		limiter = prev.RateLimiter
+	}
+
+	return &service.CacheService{
+		Cache:             c,
+		SkipTags:          skipTags,
+		DefaultCreds:      cfg.Credentials,
+		CacheManifests:    cfg.Policy.CacheManifests,
+		PrivateRegistries: privateRegistries,
+		Upstreams:         upstreams,
+		Health:            health,
+		Retries:           cfg.Upstream.Retries,
+		RetryBackoff:      cfg.Upstream.RetryBackoff,
+		RateLimiter:       limiter,
+		ServeStale:        cfg.Policy.ServeStale,
+		FillTimeout:       cfg.Policy.FillTimeout,
+		ManifestTTL:       cfg.Policy.ManifestTTL,
+		RegistryTTLs:      cfg.ManifestTTLs(),
+		ECR:               ecrAuth,
+		Stopping:          stopping,
+		RepositoryMetrics: cfg.Metrics.Repository,
+		Usage:             idx,
+		VerifyMaxSize:     int64(cfg.Policy.VerifyMaxKB) << 10,
+	}
 }
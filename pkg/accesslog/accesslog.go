@@ -0,0 +1,110 @@
+package accesslog
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// sensitiveHeaders are never logged as-is
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Registry-Cache-Token"}
+
+// Redact returns copy of headers with credentials replaced, safe to log
+func Redact(h http.Header) http.Header {
+	res := h.Clone()
+	for _, k := range sensitiveHeaders {
+		if _, ok := res[k]; ok {
+			res[k] = []string{"<redacted>"}
+		}
+	}
+	return res
+}
+
+// Entry is the access log line of a request, filled by the handler while the request is served
+type Entry struct {
+	Registry      string
+	Repository    string
+	Ref           string
+	Type          string
+	Cache         string // hit, stale, miss, skip, error
+	UpstreamBytes int64
+	TTFB          time.Duration // of the upstream response
+}
+
+type ctxKey struct{}
+
+// FromContext returns Entry of the request, nil if access log is disabled
+func FromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(ctxKey{}).(*Entry)
+	return e
+}
+
+// Handler logs one line per request of h at info level, except `/metrics`
+func Handler(logger *slog.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		e := &Entry{}
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), ctxKey{}, e)))
+
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		attrs := []any{
+			"request_id", r.Header.Get("X-Request-ID"),
+			"addr", ip,
+			"method", r.Method,
+			"uri", r.URL.Path,
+			"status", rw.status,
+			"bytes", rw.bytes,
+			"duration", time.Since(start).Seconds(),
+		}
+		if e.Registry != "" {
+			attrs = append(attrs,
+				"registry", e.Registry,
+				"repository", e.Repository,
+				"ref", e.Ref,
+				"type", e.Type,
+				"cache", e.Cache,
+				"upstream_bytes", e.UpstreamBytes,
+				"ttfb", e.TTFB.Seconds(),
+			)
+		}
+		logger.Info("access", attrs...)
+	})
+}
+
+// responseWriter records status and bytes sent to the client
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the original writer
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
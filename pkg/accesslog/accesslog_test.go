@@ -0,0 +1,53 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedact(t *testing.T) {
+	h := http.Header{"Authorization": {"Bearer secret"}, "Cookie": {"a=b"}, "Accept": {"*/*"}}
+	redacted := Redact(h)
+	assert.Equal(t, http.Header{"Authorization": {"<redacted>"}, "Cookie": {"<redacted>"}, "Accept": {"*/*"}}, redacted)
+	assert.Equal(t, "Bearer secret", h.Get("Authorization"), "original is not modified")
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	h := Handler(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e := FromContext(r.Context()); e != nil {
+			e.Registry, e.Repository, e.Ref, e.Type = "docker.io", "library/alpine", "3.20", "manifest"
+			e.Cache, e.UpstreamBytes, e.TTFB = "miss", 5, time.Second
+		}
+		w.WriteHeader(201)
+		w.Write([]byte("hello"))
+	}))
+
+	r := httptest.NewRequest("GET", "/v2/library/alpine/manifests/3.20?ns=docker.io", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Request-ID", "abc")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var line map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	delete(line, "time")
+	delete(line, "duration")
+	assert.Equal(t, map[string]any{
+		"level": "INFO", "msg": "access", "request_id": "abc", "addr": "10.0.0.1", "method": "GET",
+		"uri": "/v2/library/alpine/manifests/3.20", "status": 201.0, "bytes": 5.0,
+		"registry": "docker.io", "repository": "library/alpine", "ref": "3.20", "type": "manifest",
+		"cache": "miss", "upstream_bytes": 5.0, "ttfb": 1.0,
+	}, line)
+
+	buf.Reset()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	assert.Empty(t, buf.String())
+}
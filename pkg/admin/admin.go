@@ -0,0 +1,157 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sepich/containerd-registry-cache/pkg/gc"
+	"github.com/sepich/containerd-registry-cache/pkg/scrub"
+	"github.com/sepich/containerd-registry-cache/pkg/usage"
+)
+
+// Admin serves maintenance API, it has no auth and should only be reachable via localhost
+type Admin struct {
+	Usage    *usage.Index  // nil if disabled
+	GC       *gc.Collector // nil if not supported by the cache backend
+	Scrub    *scrub.Scrubber
+	Stopping context.Context // cancels scrub started in background on shutdown
+	Logger   *slog.Logger
+}
+
+func (a *Admin) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/gc", a.lastGC)
+	mux.HandleFunc("POST /admin/gc", a.runGC)
+	mux.HandleFunc("GET /admin/scrub", a.scrubStatus)
+	mux.HandleFunc("POST /admin/scrub", a.runScrub)
+	mux.HandleFunc("GET /admin/usage/top", a.usage(func(r *http.Request, entries map[string]*usage.Entry) (any, error) {
+		n, err := intParam(r, "n", 20)
+		if err != nil {
+			return nil, err
+		}
+		return usage.TopImages(entries, r.URL.Query().Get("by"), n), nil
+	}))
+	mux.HandleFunc("GET /admin/usage/unused", a.usage(func(r *http.Request, entries map[string]*usage.Entry) (any, error) {
+		days, err := intParam(r, "days", 30)
+		if err != nil {
+			return nil, err
+		}
+		objects := usage.UnusedSince(entries, time.Now().AddDate(0, 0, -days))
+		var size int64
+		for _, o := range objects {
+			size += o.Size
+		}
+		return map[string]any{"objects": objects, "count": len(objects), "size": size}, nil
+	}))
+	mux.HandleFunc("GET /admin/usage/registries", a.usage(func(r *http.Request, entries map[string]*usage.Entry) (any, error) {
+		return usage.Registries(entries), nil
+	}))
+}
+
+// usage wraps query of usage index entries
+func (a *Admin) usage(query func(r *http.Request, entries map[string]*usage.Entry) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.Usage == nil {
+			http.Error(w, "usage index is disabled, see --usage-index", http.StatusNotFound)
+			return
+		}
+		entries, err := a.Usage.Entries(r.Context())
+		if err != nil {
+			a.Logger.Error("Could not read usage index", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res, err := query(r, entries)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, res)
+	}
+}
+
+// lastGC returns report of the last run by any replica
+func (a *Admin) lastGC(w http.ResponseWriter, r *http.Request) {
+	if a.GC == nil {
+		http.Error(w, "garbage collection is not supported by the cache backend", http.StatusNotFound)
+		return
+	}
+	report, err := a.GC.LastReport(r.Context())
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "garbage collection has not run yet", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// runGC runs garbage collection and returns its report, `?dryRun=true` only reports objects to be deleted
+func (a *Admin) runGC(w http.ResponseWriter, r *http.Request) {
+	if a.GC == nil {
+		http.Error(w, "garbage collection is not supported by the cache backend", http.StatusNotFound)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+	report, err := a.GC.Collect(r.Context(), dryRun)
+	if errors.Is(err, gc.ErrRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		a.Logger.Error("Garbage collection failed", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// scrubStatus returns progress of the pass in progress, or report of the last one by any replica
+func (a *Admin) scrubStatus(w http.ResponseWriter, r *http.Request) {
+	if a.Scrub == nil {
+		http.Error(w, "scrub is not supported by the cache backend", http.StatusNotFound)
+		return
+	}
+	report, err := a.Scrub.Status(r.Context())
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "scrub has not run yet", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// runScrub starts a pass in background, as it could take hours
+func (a *Admin) runScrub(w http.ResponseWriter, r *http.Request) {
+	if a.Scrub == nil {
+		http.Error(w, "scrub is not supported by the cache backend", http.StatusNotFound)
+		return
+	}
+	if err := a.Scrub.Start(a.Stopping); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func intParam(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+)
+
+const realm = "containerd-registry-cache"
+
+// TokenHeader carries client token separately from `Authorization`, which is passed through to upstream
+// when containerd authenticates to the registry itself with imagePullSecrets
+const TokenHeader = "X-Registry-Cache-Token"
+
+var authTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "containerd_cache_auth_total",
+	Help: "The total number of client requests checked by auth rules",
+}, []string{"result"})
+
+// Rule allows clients matching any of CIDRs, Tokens or ClientCerts to pull images in Scope
+type Rule struct {
+	Scope       []string `yaml:"scope"`       // registry (as in `ns`) or registry/repo prefixes, empty for all
+	CIDRs       []string `yaml:"cidrs"`       // client address ranges
+	Tokens      []string `yaml:"tokens"`      // static tokens, sent in TokenHeader, as `Authorization: Bearer <token>` or Basic auth password
+	ClientCerts []string `yaml:"clientCerts"` // CN or DNS SAN of verified client certificate, `*` for any
+}
+
+// Error is distribution-style error response
+// https://distribution.github.io/distribution/spec/api/#errors
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Write sends the error to client
+func (e *Error) Write(w http.ResponseWriter) {
+	if e.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+	}
+	w.Header().Set(model.HeaderContentType, "application/json")
+	w.WriteHeader(e.Status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`+"\n", e.Code, e.Message)
+}
+
+type Authorizer interface {
+	// Authorize returns *Error if the request is not allowed to pull the object
+	Authorize(r *http.Request, object *model.ObjectIdentifier) error
+}
+
+type rule struct {
+	Rule
+	nets []*net.IPNet
+}
+
+// Rules is parsed list of Rule, empty allows everything
+type Rules struct {
+	rules []rule
+}
+
+var _ Authorizer = &Rules{}
+
+func New(rules []Rule) (*Rules, error) {
+	res := &Rules{}
+	for i, r := range rules {
+		if len(r.CIDRs) == 0 && len(r.Tokens) == 0 && len(r.ClientCerts) == 0 {
+			return nil, fmt.Errorf("auth rule %d should have cidrs, tokens or clientCerts", i)
+		}
+		parsed := rule{Rule: r}
+		for _, c := range r.CIDRs {
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				return nil, fmt.Errorf("auth rule %d: %w", i, err)
+			}
+			parsed.nets = append(parsed.nets, n)
+		}
+		for _, t := range r.Tokens {
+			if t == "" {
+				return nil, fmt.Errorf("auth rule %d has empty token", i)
+			}
+		}
+		res.rules = append(res.rules, parsed)
+	}
+	return res, nil
+}
+
+// Authorize checks the request against rules in scope of the object. Cache tokens are removed from the request
+// on any result, to not be passed to upstream. Unknown token in `Authorization` could be a registry token of containerd
+// authenticating to upstream itself, so it is treated as no credentials and kept.
+func (a *Rules) Authorize(r *http.Request, object *model.ObjectIdentifier) error {
+	token, header := clientToken(r)
+	r.Header.Del(TokenHeader)
+	if a == nil || len(a.rules) == 0 {
+		return nil
+	}
+	if t := authorizationToken(r); t != "" && a.known(t) {
+		r.Header.Del("Authorization")
+	}
+	name := object.Registry + "/" + object.Repository
+	ip := clientIP(r)
+	names := clientCertNames(r)
+
+	inScope := false
+	for _, rule := range a.rules {
+		if !rule.inScope(name) {
+			continue
+		}
+		inScope = true
+		if slices.ContainsFunc(rule.nets, func(n *net.IPNet) bool { return ip != nil && n.Contains(ip) }) {
+			authTotal.WithLabelValues("allowed").Inc()
+			return nil
+		}
+		if token != "" && slices.ContainsFunc(rule.Tokens, func(t string) bool { return subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 }) {
+			authTotal.WithLabelValues("allowed").Inc()
+			return nil
+		}
+		if len(names) != 0 && slices.ContainsFunc(rule.ClientCerts, func(c string) bool { return c == "*" || slices.Contains(names, c) }) {
+			authTotal.WithLabelValues("allowed").Inc()
+			return nil
+		}
+	}
+
+	if !inScope {
+		authTotal.WithLabelValues("denied").Inc()
+		return &Error{Status: http.StatusForbidden, Code: "DENIED", Message: "no auth rule for " + name}
+	}
+	if (token == "" || header != TokenHeader && !a.known(token)) && len(names) == 0 {
+		authTotal.WithLabelValues("unauthorized").Inc()
+		return &Error{Status: http.StatusUnauthorized, Code: "UNAUTHORIZED", Message: "authentication required"}
+	}
+	authTotal.WithLabelValues("denied").Inc()
+	return &Error{Status: http.StatusForbidden, Code: "DENIED", Message: "requested access to " + name + " is denied"}
+}
+
+// known returns true if the token is in any rule
+func (a *Rules) known(token string) bool {
+	return slices.ContainsFunc(a.rules, func(r rule) bool {
+		return slices.ContainsFunc(r.Tokens, func(t string) bool { return subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 })
+	})
+}
+
+func (r rule) inScope(name string) bool {
+	if len(r.Scope) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(r.Scope, func(s string) bool {
+		return strings.HasPrefix(name+"/", strings.TrimRight(s, "/")+"/")
+	})
+}
+
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// clientToken returns token of TokenHeader, Bearer token or Basic auth password, with the header it is in
+func clientToken(r *http.Request) (string, string) {
+	if token := strings.TrimSpace(r.Header.Get(TokenHeader)); token != "" {
+		return token, TokenHeader
+	}
+	if token := authorizationToken(r); token != "" {
+		return token, "Authorization"
+	}
+	return "", ""
+}
+
+// authorizationToken returns Bearer token or Basic auth password of `Authorization` header
+func authorizationToken(r *http.Request) string {
+	if _, pass, ok := r.BasicAuth(); ok {
+		return pass
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// clientCertNames returns CN and DNS SANs of verified client certificate
+func clientCertNames(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	return append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+}
+
+// Reloadable authorizes requests with the last stored Rules
+type Reloadable struct {
+	current atomic.Pointer[Rules]
+}
+
+var _ Authorizer = &Reloadable{}
+
+func (a *Reloadable) Store(r *Rules) {
+	a.current.Store(r)
+}
+
+func (a *Reloadable) Authorize(r *http.Request, object *model.ObjectIdentifier) error {
+	return a.current.Load().Authorize(r, object)
+}
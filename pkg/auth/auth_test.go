@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	_, err := New([]Rule{{Scope: []string{"docker.io"}}})
+	assert.ErrorContains(t, err, "should have cidrs, tokens or clientCerts")
+	_, err = New([]Rule{{CIDRs: []string{"10.0.0.0"}}})
+	assert.ErrorContains(t, err, "invalid CIDR")
+	_, err = New([]Rule{{Tokens: []string{""}}})
+	assert.ErrorContains(t, err, "empty token")
+}
+
+func TestAuthorize(t *testing.T) {
+	rules, err := New([]Rule{
+		{Scope: []string{"quay.io"}, CIDRs: []string{"10.0.0.0/8"}},
+		{Scope: []string{"docker.io", "ghcr.io/org"}, Tokens: []string{"secret"}},
+		{Scope: []string{"ghcr.io"}, ClientCerts: []string{"node1"}},
+	})
+	assert.NoError(t, err)
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "node1"}}
+	testCases := []struct {
+		name   string
+		addr   string
+		object string
+		header string
+		token  string // in TokenHeader
+		cert   *x509.Certificate
+		status int
+	}{
+		{name: "cidr", addr: "10.1.2.3:1234", object: "quay.io/any", status: 0},
+		{name: "out of scope", addr: "10.1.2.3:1234", object: "registry.k8s.io/pause", status: 403},
+		{name: "no creds", addr: "192.168.0.1:1234", object: "docker.io/library/alpine", status: 401},
+		{name: "bearer", addr: "192.168.0.1:1234", object: "docker.io/library/alpine", header: "Bearer secret", status: 0},
+		{name: "basic", addr: "192.168.0.1:1234", object: "ghcr.io/org/repo", header: "Basic dXNlcjpzZWNyZXQ=", status: 0},
+		{name: "registry token", addr: "192.168.0.1:1234", object: "docker.io/library/alpine", header: "Bearer wrong", status: 401},
+		{name: "header", addr: "192.168.0.1:1234", object: "docker.io/library/alpine", token: "secret", status: 0},
+		{name: "wrong header", addr: "192.168.0.1:1234", object: "docker.io/library/alpine", token: "wrong", status: 403},
+		{name: "token out of scope", addr: "192.168.0.1:1234", object: "ghcr.io/other/repo", header: "Bearer secret", status: 403},
+		{name: "cert", addr: "192.168.0.1:1234", object: "ghcr.io/other/repo", cert: cert, status: 0},
+		{name: "cert out of scope", addr: "192.168.0.1:1234", object: "docker.io/library/alpine", cert: cert, status: 403},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tC.addr
+			if tC.header != "" {
+				r.Header.Set("Authorization", tC.header)
+			}
+			if tC.token != "" {
+				r.Header.Set(TokenHeader, tC.token)
+			}
+			if tC.cert != nil {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tC.cert}}}
+			}
+			registry, repo, _ := strings.Cut(tC.object, "/")
+			err := rules.Authorize(r, &model.ObjectIdentifier{Registry: registry, Repository: repo})
+			if tC.status == 0 {
+				assert.NoError(t, err)
+				assert.Empty(t, r.Header.Get("Authorization"))
+				assert.Empty(t, r.Header.Get(TokenHeader))
+				return
+			}
+			var authErr *Error
+			assert.True(t, errors.As(err, &authErr))
+			assert.Equal(t, tC.status, authErr.Status)
+		})
+	}
+
+	// containerd authenticated to the registry itself with imagePullSecrets, the registry token is passed through
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(TokenHeader, "secret")
+	r.Header.Set("Authorization", "Bearer registry-token")
+	assert.NoError(t, rules.Authorize(r, &model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine"}))
+	assert.Equal(t, "Bearer registry-token", r.Header.Get("Authorization"))
+	assert.Empty(t, r.Header.Get(TokenHeader), "not passed to upstream")
+
+	var empty *Rules
+	assert.NoError(t, empty.Authorize(httptest.NewRequest("GET", "/", nil), &model.ObjectIdentifier{Registry: "docker.io"}))
+}
+
+func TestErrorWrite(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&Error{Status: http.StatusUnauthorized, Code: "UNAUTHORIZED", Message: "authentication required"}).Write(w)
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, `Basic realm="containerd-registry-cache"`, w.Header().Get("WWW-Authenticate"))
+	assert.JSONEq(t, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`, w.Body.String())
+}
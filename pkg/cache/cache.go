@@ -1,17 +1,20 @@
 package cache
 
 import (
+	"context"
 	"io"
+	"strings"
+	"time"
 
 	"github.com/sepich/containerd-registry-cache/pkg/model"
 )
 
 type CachingService interface {
-	GetCache(object *model.ObjectIdentifier) (CachedObject, CacheWriter, error)
+	GetCache(ctx context.Context, object *model.ObjectIdentifier) (CachedObject, CacheWriter, error)
 }
 
 type CachedObject interface {
-	GetReader() (io.ReadCloser, error)
+	GetReader(ctx context.Context) (io.ReadCloser, error)
 	GetMetadata() ObjMeta
 }
 type ObjMeta struct {
@@ -22,6 +25,67 @@ type ObjMeta struct {
 
 type CacheWriter interface {
 	Write(p []byte) (n int, err error)
-	Close(contentType, dockerContentDigest string) error
+	Close(ctx context.Context, contentType, dockerContentDigest string) error
 	Cleanup() // allows the writer to clean up any temporary files or resources
 }
+
+// Store is a CachingService which could be maintained in background, like usage index or GC
+type Store interface {
+	CachingService
+	// Walk calls fn for each object data in the cache, stopping on the first error returned
+	Walk(ctx context.Context, fn func(ObjectInfo) error) error
+	// Delete removes object by key, with its metadata
+	Delete(ctx context.Context, key string) error
+	// Quarantine moves object by key, with its metadata, to `_meta/quarantine/<key>` for inspection
+	Quarantine(ctx context.Context, key string) error
+	// ReadMeta reads service file by name like `usage/host.json`, returns os.ErrNotExist when missing
+	ReadMeta(ctx context.Context, name string) ([]byte, error)
+	WriteMeta(ctx context.Context, name string, data []byte) error
+	// ListMeta returns service files with name prefix, their ObjectIdentifier is empty
+	ListMeta(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	DeleteMeta(ctx context.Context, name string) error
+}
+
+type ObjectInfo struct {
+	model.ObjectIdentifier
+	Key     string // path relative to cache root
+	Size    int64
+	ModTime time.Time
+	Orphan  bool // data or metadata is missing, so the object is never served
+}
+
+// ReadObject returns content of cached object up to limit bytes, nil on miss
+func ReadObject(ctx context.Context, c CachingService, object *model.ObjectIdentifier, limit int64) ([]byte, error) {
+	cached, _, err := c.GetCache(ctx, object)
+	if err != nil || cached == nil {
+		return nil, err
+	}
+	r, err := cached.GetReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(io.LimitReader(r, limit))
+}
+
+// ExpectedDigest returns sha256 digest the object content should match, by digest reference or the one saved from
+// upstream response for tags. Empty when unknown.
+func ExpectedDigest(meta ObjMeta) string {
+	for _, d := range []string{meta.Ref, meta.DockerContentDigest} {
+		if d = strings.ToLower(d); strings.HasPrefix(d, "sha256:") {
+			return d
+		}
+	}
+	return ""
+}
+
+// Backend returns name of the cache backend for metrics
+func Backend(c CachingService) string {
+	switch c.(type) {
+	case *S3Cache:
+		return "s3"
+	case *FileCache:
+		return "file"
+	}
+	return "other"
+}
@@ -1,11 +1,13 @@
 package cache
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/sepich/containerd-registry-cache/pkg/model"
@@ -15,22 +17,28 @@ var _ CachingService = &FileCache{}
 
 type FileCache struct {
 	CacheDirectory string
+	// Xattr keeps metadata of new objects in extended attribute of data file instead of `.json` sidecar, which is set
+	// before the data is renamed into place. Existing sidecars are migrated on lookup, see also MigrateSidecars.
+	// Each mode reads the other format only on miss, to keep objects stored before switching.
+	Xattr bool
 }
 
-func (c *FileCache) GetCache(object *model.ObjectIdentifier) (CachedObject, CacheWriter, error) {
+func (c *FileCache) GetCache(ctx context.Context, object *model.ObjectIdentifier) (CachedObject, CacheWriter, error) {
 	writer := &FileWriter{
 		object:         *object,
 		cacheDirectory: c.CacheDirectory,
+		xattr:          c.Xattr,
 	}
 
 	key := filepath.Join(c.CacheDirectory, ObjectToCacheName(object))
-	manifest, size, err := c.getManifestOrNilOnMiss(key)
+	manifest, size, err := c.getManifestOrNilOnMiss(key, object)
 	if err != nil {
 		return nil, nil, err
 	}
 	if manifest == nil {
 		return nil, writer, nil
 	}
+	manifest.Registry = model.CanonicalRegistry(manifest.Registry) // as saved by previous versions
 
 	reader := &FileObject{
 		CacheManifest: *manifest,
@@ -40,9 +48,7 @@ func (c *FileCache) GetCache(object *model.ObjectIdentifier) (CachedObject, Cach
 	return reader, writer, nil
 }
 
-func (c *FileCache) getManifestOrNilOnMiss(cacheFilePath string) (*CacheManifest, int64, error) {
-	cacheFilePathManifest := cacheFilePath + cacheManifestSuffix
-
+func (c *FileCache) getManifestOrNilOnMiss(cacheFilePath string, object *model.ObjectIdentifier) (*CacheManifest, int64, error) {
 	var sizeBytes int64
 	if cacheStat, err := os.Stat(cacheFilePath); errors.Is(err, os.ErrNotExist) {
 		return nil, 0, nil
@@ -52,23 +58,36 @@ func (c *FileCache) getManifestOrNilOnMiss(cacheFilePath string) (*CacheManifest
 		sizeBytes = cacheStat.Size()
 	}
 
-	if _, err := os.Stat(cacheFilePathManifest); errors.Is(err, os.ErrNotExist) {
-		return nil, 0, nil
-	} else if err != nil {
-		return nil, 0, err
+	// the other format is only tried on miss, for objects stored before switching the mode
+	if c.Xattr {
+		manifest, err := readXattr(cacheFilePath)
+		if err == nil {
+			return manifest, sizeBytes, nil
+		} else if !errors.Is(err, errNoXattr) {
+			return nil, 0, err
+		}
 	}
 
-	manifest := &CacheManifest{}
-	manifestJson, err := os.ReadFile(cacheFilePathManifest)
-	if err != nil {
-		return nil, 0, err
-	}
-	err = json.Unmarshal(manifestJson, manifest)
-	if err != nil {
+	manifest, manifestJson, err := readSidecar(cacheFilePath, object)
+	if err == nil {
+		if c.Xattr {
+			// the object is still served from the sidecar if it fails
+			_ = migrateSidecar(cacheFilePath, manifestJson)
+		}
+		return manifest, sizeBytes, nil
+	} else if !errors.Is(err, errNoSidecar) {
 		return nil, 0, err
 	}
 
-	return manifest, sizeBytes, nil
+	if !c.Xattr {
+		manifest, err := readXattr(cacheFilePath)
+		if err == nil {
+			return manifest, sizeBytes, nil
+		} else if !errors.Is(err, errNoXattr) {
+			return nil, 0, err
+		}
+	}
+	return nil, 0, nil
 }
 
 // FileObject implements the CachedObject interface for file-based cache entries
@@ -76,7 +95,7 @@ var _ CachedObject = &FileObject{}
 
 type FileObject ObjMeta
 
-func (c *FileObject) GetReader() (io.ReadCloser, error) {
+func (c *FileObject) GetReader(ctx context.Context) (io.ReadCloser, error) {
 	return os.Open(c.Path)
 }
 func (c *FileObject) GetMetadata() ObjMeta {
@@ -91,11 +110,12 @@ type FileWriter struct {
 	cacheDirectory string
 	object         model.ObjectIdentifier
 	file           *os.File
+	xattr          bool
 }
 
 func (c *FileWriter) Write(b []byte) (n int, err error) {
 	if c.file == nil {
-		file, err := os.CreateTemp(c.cacheDirectory, c.object.Ref)
+		file, err := createTemp(c.cacheDirectory, c.object.Ref)
 		if err != nil {
 			return 0, err
 		}
@@ -106,7 +126,7 @@ func (c *FileWriter) Write(b []byte) (n int, err error) {
 }
 
 // Close will (if written to) close the temporary file, generate a cache manifest, and then move it to the cache folder.
-func (c *FileWriter) Close(contentType, dockerContentDigest string) error {
+func (c *FileWriter) Close(ctx context.Context, contentType, dockerContentDigest string) error {
 	if c.file == nil {
 		return nil
 	}
@@ -121,11 +141,6 @@ func (c *FileWriter) Close(contentType, dockerContentDigest string) error {
 	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
 		return err
 	}
-	err = os.Rename(c.file.Name(), filePath)
-	if err != nil {
-		return err
-	}
-
 	manifest := &CacheManifest{
 		ObjectIdentifier: c.object,
 
@@ -139,6 +154,25 @@ func (c *FileWriter) Close(contentType, dockerContentDigest string) error {
 		return err
 	}
 
+	if c.xattr {
+		// data and metadata are renamed into place together
+		if err := setXattr(c.file.Name(), manifestJson, false); err != nil {
+			return err
+		}
+		if err := os.Rename(c.file.Name(), filePath); err != nil {
+			return err
+		}
+		tempFiles.Delete(c.file.Name())
+		// stale one of the previous version
+		return removeSidecar(filePath)
+	}
+
+	err = os.Rename(c.file.Name(), filePath)
+	if err != nil {
+		return err
+	}
+	tempFiles.Delete(c.file.Name())
+
 	tmpManifest, err := os.CreateTemp(filepath.Dir(manifestFilePath), ".manifest-*.json")
 	if err != nil {
 		return err
@@ -157,7 +191,176 @@ func (c *FileWriter) Close(contentType, dockerContentDigest string) error {
 
 func (c *FileWriter) Cleanup() {
 	if c.file != nil {
-		_ = c.file.Close()
-		_ = os.Remove(c.file.Name())
+		removeTemp(c.file)
+	}
+}
+
+var _ Store = &FileCache{}
+
+// Walk lists data files, skipping temp files in the root and `.json` sidecars. Data without sidecar, and sidecar
+// without data (by key of the data) are reported as Orphan.
+func (c *FileCache) Walk(ctx context.Context, fn func(ObjectInfo) error) error {
+	entries, err := os.ReadDir(c.CacheDirectory)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == metaDir {
+			continue
+		}
+		if err := c.walkDir(ctx, e.Name(), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *FileCache) walkDir(ctx context.Context, dir string, fn func(ObjectInfo) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(filepath.Join(c.CacheDirectory, dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // removed meanwhile
+	} else if err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	for _, e := range entries {
+		key := filepath.ToSlash(filepath.Join(dir, e.Name()))
+		if e.IsDir() {
+			if err := c.walkDir(ctx, key, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(c.CacheDirectory, filepath.FromSlash(key))
+		if hasXattr(path) {
+			if err := c.walkFile(e, key, false, false, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		// tags could end with `.json` too, then the sidecar is `<tag>.json.json`
+		sidecar := strings.HasSuffix(e.Name(), cacheManifestSuffix) && !names[e.Name()+cacheManifestSuffix]
+		if sidecar {
+			if names[strings.TrimSuffix(e.Name(), cacheManifestSuffix)] {
+				continue
+			}
+			key = strings.TrimSuffix(key, cacheManifestSuffix)
+		}
+		// sidecar without data, or data without metadata
+		orphan := sidecar || !names[e.Name()+cacheManifestSuffix]
+		if err := c.walkFile(e, key, sidecar, orphan, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *FileCache) walkFile(e os.DirEntry, key string, sidecar, orphan bool, fn func(ObjectInfo) error) error {
+	object, ok := CacheNameToObject(key)
+	if !ok {
+		return nil
+	}
+	info, err := e.Info()
+	if err != nil {
+		return nil
+	}
+	o := ObjectInfo{ObjectIdentifier: object, Key: key, Size: info.Size(), ModTime: info.ModTime(), Orphan: orphan}
+	if sidecar {
+		o.Size = 0
+	}
+	return fn(o)
+}
+
+// Delete removes the sidecar first, so that concurrent lookup gets a miss
+func (c *FileCache) Delete(ctx context.Context, key string) error {
+	path := filepath.Join(c.CacheDirectory, filepath.FromSlash(key))
+	if err := removeSidecar(path); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (c *FileCache) Quarantine(ctx context.Context, key string) error {
+	path := filepath.Join(c.CacheDirectory, filepath.FromSlash(key))
+	dst := filepath.Join(c.CacheDirectory, metaDir, quarantineDir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	for _, suffix := range []string{cacheManifestSuffix, ""} {
+		if suffix != "" && hasXattr(path+suffix) {
+			continue // data of `<tag>.json`
+		}
+		if err := os.Rename(path+suffix, dst+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *FileCache) ReadMeta(ctx context.Context, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(c.CacheDirectory, metaDir, name))
+}
+
+// WriteMeta replaces the file atomically
+func (c *FileCache) WriteMeta(ctx context.Context, name string, data []byte) error {
+	path := filepath.Join(c.CacheDirectory, metaDir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".meta-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (c *FileCache) ListMeta(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	dir, filePrefix := filepath.Split(prefix)
+	entries, err := os.ReadDir(filepath.Join(c.CacheDirectory, metaDir, dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var res []ObjectInfo
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") || !strings.HasPrefix(e.Name(), filePrefix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		res = append(res, ObjectInfo{Key: dir + e.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return res, nil
+}
+
+func (c *FileCache) DeleteMeta(ctx context.Context, name string) error {
+	err := os.Remove(filepath.Join(c.CacheDirectory, metaDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
 	}
+	return err
 }
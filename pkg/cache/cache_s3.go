@@ -1,11 +1,15 @@
 package cache
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -24,27 +28,18 @@ type S3Cache struct {
 	uploader       *manager.Uploader
 }
 
-func NewS3Cache(bucket, cacheDir string) (*S3Cache, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+func NewS3Cache(ctx context.Context, bucket, cacheDir string) (*S3Cache, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to load AWS config: %v", err)
 	}
-	// check access on startup
 	client := s3.NewFromConfig(cfg, func(options *s3.Options) {
 		// There are files with sha256 checksums in the bucket, but SDK can only verify CRC32
 		// https://docs.aws.amazon.com/sdkref/latest/guide/feature-dataintegrity.html#dataintegrity-sdk-compat
 		// SDK 2025/07/18 16:06:36 WARN Skipped validation of multipart checksum.
 		options.DisableLogOutputChecksumValidationSkipped = true
 	})
-	_, err = client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-		Bucket:  &bucket,
-		MaxKeys: aws.Int32(1),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("Failed to access S3 bucket `%s`: %v", bucket, err)
-	}
-
-	return &S3Cache{
+	c := &S3Cache{
 		bucket:         bucket,
 		client:         client,
 		cacheDirectory: cacheDir,
@@ -52,10 +47,27 @@ func NewS3Cache(bucket, cacheDir string) (*S3Cache, error) {
 			u.Concurrency = 4
 			u.LeavePartsOnError = false
 		}),
-	}, nil
+	}
+	// check access on startup
+	if err = c.Check(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Check verifies the bucket is accessible
+func (c *S3Cache) Check(ctx context.Context) error {
+	_, err := c.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  &c.bucket,
+		MaxKeys: aws.Int32(1),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to access S3 bucket `%s`: %v", c.bucket, err)
+	}
+	return nil
 }
 
-func (c *S3Cache) GetCache(object *model.ObjectIdentifier) (CachedObject, CacheWriter, error) {
+func (c *S3Cache) GetCache(ctx context.Context, object *model.ObjectIdentifier) (CachedObject, CacheWriter, error) {
 	key := ObjectToCacheName(object)
 	writer := &S3Writer{
 		object:         *object,
@@ -65,7 +77,7 @@ func (c *S3Cache) GetCache(object *model.ObjectIdentifier) (CachedObject, CacheW
 		key:            key,
 		cacheDirectory: c.cacheDirectory,
 	}
-	obj, err := c.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+	obj, err := c.client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: &c.bucket,
 		Key:    &key,
 	})
@@ -102,9 +114,9 @@ type S3Object struct {
 	bucket string
 }
 
-func (o *S3Object) GetReader() (io.ReadCloser, error) {
+func (o *S3Object) GetReader(ctx context.Context) (io.ReadCloser, error) {
 	// TODO: return presigned link for blobs?
-	obj, err := o.client.GetObject(context.TODO(), &s3.GetObjectInput{
+	obj, err := o.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: &o.bucket,
 		Key:    &o.Path,
 	})
@@ -134,7 +146,7 @@ type S3Writer struct {
 
 func (w *S3Writer) Write(b []byte) (n int, err error) {
 	if w.file == nil {
-		file, err := os.CreateTemp(w.cacheDirectory, w.object.Ref)
+		file, err := createTemp(w.cacheDirectory, w.object.Ref)
 		if err != nil {
 			return 0, err
 		}
@@ -144,7 +156,7 @@ func (w *S3Writer) Write(b []byte) (n int, err error) {
 	return w.file.Write(b)
 }
 
-func (w *S3Writer) Close(contentType, dockerContentDigest string) error {
+func (w *S3Writer) Close(ctx context.Context, contentType, dockerContentDigest string) error {
 	if w.file == nil {
 		return nil
 	}
@@ -161,7 +173,7 @@ func (w *S3Writer) Close(contentType, dockerContentDigest string) error {
 	// https://docs.aws.amazon.com/AmazonS3/latest/userguide/checking-object-integrity.html#MultipartUploads-Checksums
 	// https://github.com/aws/aws-sdk-go-v2/issues/1040#issuecomment-1076796892
 	// file on disk sha256 is already validated, and SDK would validate upload by CRC32
-	_, err = w.uploader.Upload(context.TODO(), &s3.PutObjectInput{
+	_, err = w.uploader.Upload(ctx, &s3.PutObjectInput{
 		Bucket:        aws.String(w.bucket),
 		Key:           aws.String(w.key),
 		Body:          w.file,
@@ -172,6 +184,17 @@ func (w *S3Writer) Close(contentType, dockerContentDigest string) error {
 		},
 	})
 	if err != nil {
+		// uploader aborts multipart upload on failure, but that fails too when ctx is cancelled (on shutdown)
+		var multipartErr manager.MultiUploadFailure
+		if ctx.Err() != nil && errors.As(err, &multipartErr) {
+			abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+			defer cancel()
+			w.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(w.bucket),
+				Key:      aws.String(w.key),
+				UploadId: aws.String(multipartErr.UploadID()),
+			})
+		}
 		return fmt.Errorf("failed to upload object: %w", err)
 	}
 
@@ -180,7 +203,100 @@ func (w *S3Writer) Close(contentType, dockerContentDigest string) error {
 
 func (w *S3Writer) Cleanup() {
 	if w.file != nil {
-		_ = w.file.Close()
-		_ = os.Remove(w.file.Name())
+		removeTemp(w.file)
+	}
+}
+
+var _ Store = &S3Cache{}
+
+func (c *S3Cache) Walk(ctx context.Context, fn func(ObjectInfo) error) error {
+	p := s3.NewListObjectsV2Paginator(c.client, &s3.ListObjectsV2Input{Bucket: &c.bucket})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, o := range page.Contents {
+			object, ok := CacheNameToObject(*o.Key)
+			if !ok {
+				continue
+			}
+			if err := fn(ObjectInfo{ObjectIdentifier: object, Key: *o.Key, Size: *o.Size, ModTime: *o.LastModified}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *S3Cache) Delete(ctx context.Context, key string) error {
+	_, err := c.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &c.bucket,
+		Key:    &key,
+	})
+	return err
+}
+
+// Quarantine copies object in a single request, which is limited to 5GB
+func (c *S3Cache) Quarantine(ctx context.Context, key string) error {
+	_, err := c.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     &c.bucket,
+		Key:        aws.String(metaDir + "/" + quarantineDir + "/" + key),
+		CopySource: aws.String(url.PathEscape(c.bucket + "/" + key)),
+	})
+	if err != nil {
+		return err
+	}
+	return c.Delete(ctx, key)
+}
+
+func (c *S3Cache) ReadMeta(ctx context.Context, name string) ([]byte, error) {
+	obj, err := c.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &c.bucket,
+		Key:    aws.String(metaDir + "/" + name),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	defer obj.Body.Close()
+	return io.ReadAll(obj.Body)
+}
+
+func (c *S3Cache) WriteMeta(ctx context.Context, name string, data []byte) error {
+	_, err := c.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &c.bucket,
+		Key:    aws.String(metaDir + "/" + name),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (c *S3Cache) ListMeta(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var res []ObjectInfo
+	p := s3.NewListObjectsV2Paginator(c.client, &s3.ListObjectsV2Input{
+		Bucket: &c.bucket,
+		Prefix: aws.String(metaDir + "/" + prefix),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range page.Contents {
+			res = append(res, ObjectInfo{Key: strings.TrimPrefix(*o.Key, metaDir+"/"), Size: *o.Size, ModTime: *o.LastModified})
+		}
 	}
+	return res, nil
+}
+
+func (c *S3Cache) DeleteMeta(ctx context.Context, name string) error {
+	_, err := c.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &c.bucket,
+		Key:    aws.String(metaDir + "/" + name),
+	})
+	return err
 }
@@ -1,12 +1,14 @@
 package cache
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/sepich/containerd-registry-cache/pkg/model"
 	"github.com/stretchr/testify/assert"
@@ -33,7 +35,7 @@ func TestReadWriteFromCache(t *testing.T) {
 				Ref:        "v1.2.3",
 				Type:       model.ObjectTypeManifest,
 			},
-			name:     "docker.io/user/repository/v1.2.3",
+			name:     "registry-1.docker.io/user/repository/v1.2.3", // as normalized by previous versions
 			contents: []byte(`6bytes`),
 			manifest: []byte(`{
 				"Registry": "docker.io",
@@ -78,7 +80,7 @@ func TestReadWriteFromCache(t *testing.T) {
 				CacheDirectory: tmpDir,
 			}
 
-			cachedObject, writer, err := cacheService.GetCache(&tC.object)
+			cachedObject, writer, err := cacheService.GetCache(context.Background(), &tC.object)
 			assert.Nil(t, err)
 			assert.NotNil(t, writer)
 			assert.NotNil(t, cachedObject)
@@ -88,7 +90,7 @@ func TestReadWriteFromCache(t *testing.T) {
 			assert.Equal(t, contentType, meta.ContentType)
 			assert.Equal(t, digest, meta.DockerContentDigest)
 
-			reader, err := cachedObject.GetReader()
+			reader, err := cachedObject.GetReader(context.Background())
 			assert.Nil(t, err)
 			defer reader.Close()
 			contents, err := io.ReadAll(reader)
@@ -107,7 +109,7 @@ func TestReadWriteFromCache(t *testing.T) {
 				CacheDirectory: tmpDir,
 			}
 
-			cachedObject, writer, err := cacheService.GetCache(&tC.object)
+			cachedObject, writer, err := cacheService.GetCache(context.Background(), &tC.object)
 			assert.Nil(t, err)
 			assert.NotNil(t, writer)
 			assert.Nil(t, cachedObject)
@@ -116,7 +118,7 @@ func TestReadWriteFromCache(t *testing.T) {
 			assert.Nil(t, err)
 			assert.Equal(t, 6, n)
 
-			err = writer.Close(headers.Get(model.HeaderContentType), headers.Get(model.HeaderDockerContentDigest))
+			err = writer.Close(context.Background(), headers.Get(model.HeaderContentType), headers.Get(model.HeaderDockerContentDigest))
 			assert.Nil(t, err)
 
 			writtenContents, err := os.ReadFile(filepath.Join(tmpDir, tC.name))
@@ -135,3 +137,167 @@ func TestReadWriteFromCache(t *testing.T) {
 		})
 	}
 }
+
+func TestSweepTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{".tmp-v1.2.3123", "sha256:abc123", ".tmp-sha256:def456", "other"} {
+		p := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(p, []byte("x"), 0644))
+		if name != ".tmp-sha256:def456" {
+			assert.NoError(t, os.Chtimes(p, old, old))
+		}
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "blobs"), 0755))
+
+	removed, err := SweepTempFiles(dir, 10*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.Equal(t, []string{".tmp-sha256:def456", "blobs", "other"}, names)
+}
+
+func TestCheckDir(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, CheckDir(dir, 1))
+	assert.ErrorContains(t, CheckDir(dir, 1<<62), "less than")
+	assert.ErrorContains(t, CheckDir(filepath.Join(dir, "missing"), 1), "not writable")
+}
+
+func TestWalk(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c := &FileCache{CacheDirectory: dir}
+	objects := []model.ObjectIdentifier{
+		{Registry: "docker.io", Repository: "library/alpine", Ref: "v1.json", Type: model.ObjectTypeManifest},
+		{Ref: "sha256:65f65e75f5eed0e6ce330028a88f1d62475ea0c4a3d8dc038bde7866aeedf76d", Type: model.ObjectTypeBlob},
+	}
+	for _, o := range objects {
+		_, w, err := c.GetCache(ctx, &o)
+		assert.NoError(t, err)
+		w.Write([]byte("data"))
+		assert.NoError(t, w.Close(ctx, "", ""))
+	}
+	assert.FileExists(t, filepath.Join(dir, "registry-1.docker.io/library/alpine/v1.json"), "key of previous versions")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, tempPrefix+"x"), nil, 0644))
+	assert.NoError(t, c.WriteMeta(ctx, "usage/a.json", []byte("{}")))
+
+	var found []model.ObjectIdentifier
+	assert.NoError(t, c.Walk(ctx, func(o ObjectInfo) error {
+		assert.Equal(t, int64(4), o.Size)
+		assert.Equal(t, ObjectToCacheName(&o.ObjectIdentifier), o.Key)
+		found = append(found, o.ObjectIdentifier)
+		return nil
+	}))
+	assert.ElementsMatch(t, objects, found)
+
+	meta, err := c.ListMeta(ctx, "usage/")
+	assert.NoError(t, err)
+	assert.Len(t, meta, 1)
+	assert.Equal(t, "usage/a.json", meta[0].Key)
+	data, err := c.ReadMeta(ctx, "usage/a.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(data))
+	assert.NoError(t, c.DeleteMeta(ctx, "usage/a.json"))
+	_, err = c.ReadMeta(ctx, "usage/a.json")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestXattr(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c := &FileCache{CacheDirectory: dir, Xattr: true}
+	if err := c.CheckXattr(); err != nil {
+		t.Skip(err)
+	}
+	sidecar := &FileCache{CacheDirectory: dir}
+	writeBody := func(c *FileCache, object model.ObjectIdentifier, body, digest string) {
+		_, w, err := c.GetCache(ctx, &object)
+		assert.NoError(t, err)
+		w.Write([]byte(body))
+		assert.NoError(t, w.Close(ctx, "application/json", digest))
+	}
+	write := func(c *FileCache, object model.ObjectIdentifier, digest string) {
+		writeBody(c, object, "data", digest)
+	}
+	tag := model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: "v1", Type: model.ObjectTypeManifest}
+	jsonTag := model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: "v3.json", Type: model.ObjectTypeManifest}
+	blob := model.ObjectIdentifier{Ref: "sha256:65f65e75f5eed0e6ce330028a88f1d62475ea0c4a3d8dc038bde7866aeedf76d", Type: model.ObjectTypeBlob}
+	for _, o := range []model.ObjectIdentifier{tag, jsonTag, blob} {
+		write(sidecar, o, "sha256:old")
+	}
+
+	// lookup migrates sidecar
+	cached, _, err := c.GetCache(ctx, &tag)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:old", cached.GetMetadata().DockerContentDigest)
+	path := filepath.Join(dir, ObjectToCacheName(&tag))
+	assert.NoFileExists(t, path+".json")
+	assert.True(t, hasXattr(path))
+
+	// the rest are migrated in background, `<tag>.json` data is not mistaken for sidecar
+	n, err := c.MigrateSidecars(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	for _, o := range []model.ObjectIdentifier{tag, jsonTag, blob} {
+		assert.NoFileExists(t, filepath.Join(dir, ObjectToCacheName(&o))+".json")
+		cached, _, err := c.GetCache(ctx, &o)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), cached.GetMetadata().SizeBytes)
+		assert.Equal(t, "application/json", cached.GetMetadata().ContentType)
+	}
+
+	// new versions get metadata with data, removing stale sidecar
+	assert.NoError(t, os.WriteFile(path+".json", []byte(`{"DockerContentDigest":"sha256:stale"}`), 0644))
+	write(c, tag, "sha256:new")
+	assert.NoFileExists(t, path+".json")
+	cached, _, err = c.GetCache(ctx, &tag)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:new", cached.GetMetadata().DockerContentDigest)
+
+	orphan := model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: "v2", Type: model.ObjectTypeManifest}
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, ObjectToCacheName(&orphan)), []byte("data"), 0644))
+	found := map[string]bool{}
+	assert.NoError(t, c.Walk(ctx, func(o ObjectInfo) error {
+		assert.Equal(t, ObjectToCacheName(&o.ObjectIdentifier), o.Key)
+		found[o.Ref] = o.Orphan
+		return nil
+	}))
+	assert.Equal(t, map[string]bool{tag.Ref: false, jsonTag.Ref: false, blob.Ref: false, orphan.Ref: true}, found)
+
+	// after switching back to sidecars, metadata is still read from xattrs
+	cached, _, err = sidecar.GetCache(ctx, &tag)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:new", cached.GetMetadata().DockerContentDigest)
+	clear(found)
+	assert.NoError(t, sidecar.Walk(ctx, func(o ObjectInfo) error {
+		found[o.Ref] = o.Orphan
+		return nil
+	}))
+	assert.Equal(t, map[string]bool{tag.Ref: false, jsonTag.Ref: false, blob.Ref: false, orphan.Ref: true}, found)
+
+	// no sidecars to clash with `<tag>.json`, which data is not mistaken for sidecar of `<tag>` in both modes
+	writeBody(c, model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: "v1.json", Type: model.ObjectTypeManifest},
+		`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`, "sha256:json")
+	write(c, tag, "sha256:new")
+	for _, fc := range []*FileCache{c, sidecar} {
+		for ref, digest := range map[string]string{"v1": "sha256:new", "v1.json": "sha256:json"} {
+			cached, _, err := fc.GetCache(ctx, &model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: ref, Type: model.ObjectTypeManifest})
+			assert.NoError(t, err)
+			if assert.NotNil(t, cached, ref) {
+				assert.Equal(t, digest, cached.GetMetadata().DockerContentDigest, ref)
+			}
+		}
+	}
+
+	assert.NoError(t, c.Quarantine(ctx, ObjectToCacheName(&tag)))
+	assert.True(t, hasXattr(filepath.Join(dir, metaDir, quarantineDir, ObjectToCacheName(&tag))))
+	assert.FileExists(t, path+".json", "data of `v1.json`")
+	assert.NoError(t, c.Delete(ctx, ObjectToCacheName(&blob)))
+	assert.NoError(t, c.Delete(ctx, ObjectToCacheName(&tag)))
+	assert.FileExists(t, path+".json")
+}
@@ -1,8 +1,12 @@
 package cache
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sepich/containerd-registry-cache/pkg/model"
@@ -10,6 +14,45 @@ import (
 
 var cacheManifestSuffix = ".json"
 
+// metaDir keeps service files, like usage index, it could not clash with registry hosts
+const metaDir = "_meta"
+
+// quarantineDir in metaDir keeps corrupted objects
+const quarantineDir = "quarantine"
+
+// tempPrefix is for files being downloaded in the root of cache directory
+const tempPrefix = ".tmp-"
+
+// tempFiles are being written by this process
+var tempFiles sync.Map
+
+func createTemp(dir, ref string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, tempPrefix+ref)
+	if err == nil {
+		tempFiles.Store(f.Name(), struct{}{})
+	}
+	return f, err
+}
+
+func removeTemp(f *os.File) {
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+	tempFiles.Delete(f.Name())
+}
+
+// RemoveTempFiles removes files of downloads still in progress by this process, on shutdown
+func RemoveTempFiles() int {
+	var removed int
+	tempFiles.Range(func(name, _ any) bool {
+		if os.Remove(name.(string)) == nil {
+			removed++
+		}
+		tempFiles.Delete(name)
+		return true
+	})
+	return removed
+}
+
 type CacheManifest struct {
 	model.ObjectIdentifier
 
@@ -26,7 +69,75 @@ func ObjectToCacheName(object *model.ObjectIdentifier) string {
 	if object.Type == model.ObjectTypeBlob {
 		key = fmt.Sprintf("blobs/%s/%s", id[0:2], id)
 	} else {
-		key = fmt.Sprintf("%s/%s/%s", object.Registry, object.Repository, object.Ref)
+		// keys of previous versions are kept, so the cache stays warm on upgrade
+		key = fmt.Sprintf("%s/%s/%s", model.LegacyRegistry(object.Registry), object.Repository, object.Ref)
 	}
 	return key
 }
+
+// CacheNameToObject parses ObjectToCacheName result back, blobs get no registry and repository
+func CacheNameToObject(key string) (model.ObjectIdentifier, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) == 3 && parts[0] == "blobs" && len(parts[1]) == 2 && strings.HasPrefix(parts[2], parts[1]) {
+		return model.ObjectIdentifier{Ref: "sha256:" + parts[2], Type: model.ObjectTypeBlob}, true
+	}
+	if len(parts) < 3 || parts[0] == metaDir {
+		return model.ObjectIdentifier{}, false
+	}
+	return model.ObjectIdentifier{
+		Registry:   model.CanonicalRegistry(parts[0]),
+		Repository: strings.Join(parts[1:len(parts)-1], "/"),
+		Ref:        parts[len(parts)-1],
+		Type:       model.ObjectTypeManifest,
+	}, true
+}
+
+// SweepTempFiles removes temp files left in cache directory by interrupted downloads. Only files not modified
+// for olderThan are removed, as the directory could be shared with other running instances.
+func SweepTempFiles(dir string, olderThan time.Duration) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var removed int
+	var errs []error
+	for _, e := range entries {
+		// also blob downloads of previous versions, named by digest
+		if !e.Type().IsRegular() || !(strings.HasPrefix(e.Name(), tempPrefix) || strings.HasPrefix(e.Name(), "sha256:")) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < olderThan {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed++
+	}
+	return removed, errors.Join(errs...)
+}
+
+// CheckDir verifies dir is writable and has at least minFree bytes available
+func CheckDir(dir string, minFree uint64) error {
+	f, err := os.CreateTemp(dir, tempPrefix+"check")
+	if err != nil {
+		return fmt.Errorf("cache dir is not writable: %w", err)
+	}
+	_, err = f.Write([]byte("ok"))
+	f.Close()
+	os.Remove(f.Name())
+	if err != nil {
+		return fmt.Errorf("cache dir is not writable: %w", err)
+	}
+
+	free, err := diskFree(dir)
+	if err != nil {
+		return err
+	}
+	if free < minFree {
+		return fmt.Errorf("cache dir has %dMB free, less than %dMB required", free>>20, minFree>>20)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package cache
+
+import "golang.org/x/sys/unix"
+
+// diskFree returns bytes available to unprivileged user on filesystem of dir
+func diskFree(dir string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+)
+
+// xattrName keeps CacheManifest json on data file, instead of the sidecar
+const xattrName = "user.containerd-registry-cache"
+
+var errNoXattr = errors.New("no metadata xattr")
+
+var errNoSidecar = errors.New("no metadata sidecar")
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this OS")
+
+func readXattr(path string) (*CacheManifest, error) {
+	data, err := getXattr(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &CacheManifest{}
+	return manifest, json.Unmarshal(data, manifest)
+}
+
+// CheckXattr verifies the cache dir filesystem supports user extended attributes
+func (c *FileCache) CheckXattr() error {
+	f, err := os.CreateTemp(c.CacheDirectory, tempPrefix+"check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := setXattr(f.Name(), []byte("{}"), false); err != nil {
+		return fmt.Errorf("cache dir does not support extended attributes: %w", err)
+	}
+	return nil
+}
+
+// migrateSidecar moves metadata of data file at path to xattr. It is only created if missing, so that metadata of
+// data replaced concurrently is not overwritten by the stale sidecar.
+func migrateSidecar(path string, manifestJson []byte) error {
+	if err := setXattr(path, manifestJson, true); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	return removeSidecar(path)
+}
+
+// readSidecar returns metadata of object with data at path from its sidecar, or errNoSidecar. The sidecar path could
+// be data of `<tag>.json` with xattr instead, which is told apart by the object it describes.
+func readSidecar(path string, object *model.ObjectIdentifier) (*CacheManifest, []byte, error) {
+	manifestJson, err := os.ReadFile(path + cacheManifestSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, errNoSidecar
+	} else if err != nil {
+		return nil, nil, err
+	}
+	manifest := &CacheManifest{}
+	if json.Unmarshal(manifestJson, manifest) != nil || manifest.Ref != object.Ref || manifest.Type != object.Type {
+		return nil, nil, errNoSidecar
+	}
+	return manifest, manifestJson, nil
+}
+
+// removeSidecar of data at path, unless it is data of `<tag>.json` with xattr
+func removeSidecar(path string) error {
+	if hasXattr(path + cacheManifestSuffix) {
+		return nil
+	}
+	if err := os.Remove(path + cacheManifestSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// MigrateSidecars moves metadata of all the cached objects from sidecars to xattrs, returns number of migrated ones.
+// Lookups migrate objects too, so it is safe to run in background while serving.
+func (c *FileCache) MigrateSidecars(ctx context.Context) (int, error) {
+	var migrated int
+	err := filepath.WalkDir(c.CacheDirectory, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil // removed meanwhile
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == filepath.Join(c.CacheDirectory, metaDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") || !strings.HasSuffix(d.Name(), cacheManifestSuffix) || hasXattr(path) {
+			return nil
+		}
+		// data of `<tag>.json` has `<tag>.json.json` sidecar
+		if _, err := os.Stat(path + cacheManifestSuffix); err == nil {
+			return nil
+		}
+		data := strings.TrimSuffix(path, cacheManifestSuffix)
+		if _, err := os.Stat(data); err != nil {
+			return nil // orphan sidecar
+		}
+		manifestJson, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil // migrated by lookup
+		} else if err != nil {
+			return err
+		}
+		if err := migrateSidecar(data, manifestJson); err != nil {
+			return err
+		}
+		migrated++
+		return nil
+	})
+	return migrated, err
+}
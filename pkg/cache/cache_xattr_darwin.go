@@ -0,0 +1,6 @@
+package cache
+
+import "golang.org/x/sys/unix"
+
+// errnoNoAttr is returned by getxattr for missing attribute
+const errnoNoAttr = unix.ENOATTR
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package cache
+
+import "os"
+
+func getXattr(path string) ([]byte, error) {
+	return nil, errNoXattr
+}
+
+func hasXattr(path string) bool {
+	return false
+}
+
+func setXattr(path string, data []byte, onlyCreate bool) error {
+	return &os.PathError{Op: "setxattr", Path: path, Err: errXattrUnsupported}
+}
@@ -0,0 +1,45 @@
+//go:build linux || darwin
+
+package cache
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func getXattr(path string) ([]byte, error) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := unix.Getxattr(path, xattrName, buf)
+		if errors.Is(err, unix.ERANGE) {
+			buf = make([]byte, 2*len(buf))
+			continue
+		}
+		if errors.Is(err, errnoNoAttr) || errors.Is(err, unix.ENOTSUP) {
+			return nil, errNoXattr // or the filesystem does not support xattrs
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		return buf[:n], nil
+	}
+}
+
+func hasXattr(path string) bool {
+	_, err := unix.Getxattr(path, xattrName, nil)
+	return err == nil
+}
+
+// setXattr stores metadata on path, with onlyCreate it fails with os.ErrExist if there is one already
+func setXattr(path string, data []byte, onlyCreate bool) error {
+	flags := 0
+	if onlyCreate {
+		flags = unix.XATTR_CREATE
+	}
+	if err := unix.Setxattr(path, xattrName, data, flags); err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return nil
+}
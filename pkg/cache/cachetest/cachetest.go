@@ -0,0 +1,48 @@
+// Package cachetest has helpers to fill caches in tests
+package cachetest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// Digest returns sha256 digest of body
+func Digest(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Blob returns identifier of blob with body
+func Blob(body string) model.ObjectIdentifier {
+	return model.ObjectIdentifier{Ref: Digest(body), Type: model.ObjectTypeBlob}
+}
+
+// Put stores object with body to c, returns its cache key
+func Put(t testing.TB, c cache.CachingService, object model.ObjectIdentifier, body, contentType, dockerContentDigest string) string {
+	t.Helper()
+	ctx := context.Background()
+	_, w, err := c.GetCache(ctx, &object)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte(body))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close(ctx, contentType, dockerContentDigest))
+	return cache.ObjectToCacheName(&object)
+}
+
+// PutAged stores object with body to c like Put, with modification time age ago, returns its cache key
+func PutAged(t testing.TB, c *cache.FileCache, object model.ObjectIdentifier, body string, age time.Duration) string {
+	t.Helper()
+	key := Put(t, c, object, body, "", "")
+	mtime := time.Now().Add(-age)
+	assert.NoError(t, os.Chtimes(filepath.Join(c.CacheDirectory, filepath.FromSlash(key)), mtime, mtime))
+	return key
+}
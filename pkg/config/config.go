@@ -0,0 +1,245 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sepich/containerd-registry-cache/pkg/auth"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+	"github.com/sepich/containerd-registry-cache/pkg/service"
+	"github.com/sepich/containerd-registry-cache/pkg/upstream"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the structured configuration, which could be set by flags and then overridden by the config file.
+// Everything except Storage could be reloaded at runtime.
+type Config struct {
+	Storage     Storage                          `yaml:"storage"`
+	Policy      Policy                           `yaml:"policy"`
+	Upstream    Upstream                         `yaml:"upstream"`
+	Registries  map[string]Registry              `yaml:"registries"`
+	Credentials map[string]service.RegistryCreds `yaml:"credentials"`
+	ECR         ECR                              `yaml:"ecr"`
+	Auth        []auth.Rule                      `yaml:"auth"` // clients allowed to use the cache, empty for all
+	Metrics     Metrics                          `yaml:"metrics"`
+	GC          GC                               `yaml:"gc"`
+	Scrub       Scrub                            `yaml:"scrub"`
+}
+
+// Storage requires restart to change
+type Storage struct {
+	CacheDir string `yaml:"cacheDir"`
+	Bucket   string `yaml:"bucket"`
+	Metadata string `yaml:"metadata"` // Where cache dir keeps metadata of objects: sidecar or xattr
+}
+
+type Policy struct {
+	SkipTags       string        `yaml:"skipTags"`       // RegEx of manifest tags to skip caching
+	CacheManifests bool          `yaml:"cacheManifests"` // Enable manifests cache
+	ManifestTTL    time.Duration `yaml:"manifestTTL"`    // Refetch cached manifests after, 0 to keep forever
+	ServeStale     bool          `yaml:"serveStale"`     // Serve skipped and expired manifests when upstream is rate limited
+	FillTimeout    time.Duration `yaml:"fillTimeout"`    // Let cache fill finish after client disconnects
+	VerifyMaxKB    int           `yaml:"verifyMaxKB"`    // Verify digest of cached objects up to this size before serving, 0 to disable
+}
+
+type Upstream struct {
+	Failures          int           `yaml:"failures"`          // Consecutive failures to skip upstream for cooldown
+	Cooldown          time.Duration `yaml:"cooldown"`          // Duration to skip failing upstream for
+	Retries           int           `yaml:"retries"`           // Attempts to resume interrupted blob download
+	RetryBackoff      time.Duration `yaml:"retryBackoff"`      // Initial delay between resume attempts
+	RateLimitWait     time.Duration `yaml:"rateLimitWait"`     // Max time to wait for rate limit
+	RateLimitPerCreds bool          `yaml:"rateLimitPerCreds"` // Separate rate limit for each credentials key
+}
+
+// Registry settings are keyed by registry (as in `ns`) with optional repository prefix,
+// except RateLimit, which is keyed by upstream host.
+type Registry struct {
+	Upstreams   []string      `yaml:"upstreams"`   // Ordered list of upstreams to rewrite prefix to
+	Private     bool          `yaml:"private"`     // Skip manifests caching
+	ManifestTTL time.Duration `yaml:"manifestTTL"` // Overrides Policy.ManifestTTL
+	RateLimit   *RateLimit    `yaml:"rateLimit"`   // Rate limit of requests to this upstream host
+	Retention   time.Duration `yaml:"retention"`   // Overrides GC.Retention for manifests
+}
+
+// ECR enables native auth for ECR registries without credentials configured
+type ECR struct {
+	Enabled bool              `yaml:"enabled"`
+	Roles   map[string]string `yaml:"roles"` // account id -> role ARN to assume for cross-account pulls
+}
+
+type Metrics struct {
+	Repository bool `yaml:"repository"` // add repository label, limited to first 100 ones
+}
+
+// GC is the garbage collection of the cache
+type GC struct {
+	Interval  time.Duration `yaml:"interval"`  // Between scheduled runs, 0 to disable them
+	Retention time.Duration `yaml:"retention"` // Delete manifests and unreferenced blobs not accessed (modified without usage index) for, 0 to disable GC
+	DryRun    bool          `yaml:"dryRun"`    // Only report scheduled runs
+}
+
+// Scrub is the background integrity check of the cache
+type Scrub struct {
+	Interval time.Duration `yaml:"interval"` // Between passes, 0 to disable them
+	RateMB   int           `yaml:"rateMB"`   // Read rate limit in MB/s, 0 for unlimited
+	Delete   bool          `yaml:"delete"`   // Delete corrupt and orphaned objects instead of quarantine
+}
+
+type RateLimit struct {
+	RPS   float64 `yaml:"rps"`
+	Burst int     `yaml:"burst"`
+}
+
+var accountRe = regexp.MustCompile(`^\d{12}$`)
+
+// Decode overrides cfg values with the ones set in yaml data. Unknown fields are rejected.
+func Decode(data []byte, cfg *Config) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// Validate checks that all the settings could be applied
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Storage.CacheDir == "" {
+		errs = append(errs, errors.New("storage.cacheDir should be set"))
+	}
+	if c.Storage.Metadata != "" && c.Storage.Metadata != "sidecar" && c.Storage.Metadata != "xattr" {
+		errs = append(errs, fmt.Errorf("storage.metadata should be sidecar or xattr, got `%s`", c.Storage.Metadata))
+	}
+	if _, err := c.SkipTagsRegexp(); err != nil {
+		errs = append(errs, fmt.Errorf("policy.skipTags: %w", err))
+	}
+	if c.Policy.ManifestTTL < 0 || c.Policy.FillTimeout < 0 || c.Policy.VerifyMaxKB < 0 {
+		errs = append(errs, errors.New("policy settings should not be negative"))
+	}
+	if c.Upstream.Failures < 0 || c.Upstream.Retries < 0 || c.Upstream.Cooldown < 0 || c.Upstream.RetryBackoff < 0 || c.Upstream.RateLimitWait < 0 {
+		errs = append(errs, errors.New("upstream settings should not be negative"))
+	}
+	if _, err := c.Rewriter(); err != nil {
+		errs = append(errs, err)
+	}
+	for name, r := range c.Registries {
+		if r.ManifestTTL < 0 {
+			errs = append(errs, fmt.Errorf("registries.%s.manifestTTL should not be negative", name))
+		}
+		if r.Retention < 0 {
+			errs = append(errs, fmt.Errorf("registries.%s.retention should not be negative", name))
+		}
+		if r.RateLimit != nil && (r.RateLimit.RPS <= 0 || r.RateLimit.Burst < 0) {
+			errs = append(errs, fmt.Errorf("registries.%s.rateLimit should have positive rps", name))
+		}
+		if r.RateLimit != nil && strings.Contains(name, "/") {
+			errs = append(errs, fmt.Errorf("registries.%s.rateLimit should be keyed by upstream host, without repository", name))
+		}
+	}
+	if c.GC.Interval < 0 || c.GC.Retention < 0 {
+		errs = append(errs, errors.New("gc durations should not be negative"))
+	}
+	if c.Scrub.Interval < 0 || c.Scrub.RateMB < 0 {
+		errs = append(errs, errors.New("scrub settings should not be negative"))
+	}
+	for account, role := range c.ECR.Roles {
+		if !accountRe.MatchString(account) || !strings.HasPrefix(role, "arn:") {
+			errs = append(errs, fmt.Errorf("ecr.roles should map 12-digit account id to role ARN, got `%s: %s`", account, role))
+		}
+	}
+	if _, err := auth.New(c.Auth); err != nil {
+		errs = append(errs, err)
+	}
+	for name, creds := range c.Credentials {
+		if creds.Provider != nil && creds.Provider.Command == "" {
+			errs = append(errs, fmt.Errorf("credentials provider for `%s` should have command", name))
+		}
+		if creds.Token == "" && creds.IdentityToken == "" && creds.Helper == "" && creds.Provider == nil && (creds.Username == "" || creds.Password == "") {
+			errs = append(errs, fmt.Errorf("credentials for `%s` should have username and password, identitytoken, token, helper or provider", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) SkipTagsRegexp() (*regexp.Regexp, error) {
+	return regexp.Compile(c.Policy.SkipTags)
+}
+
+// Rewriter returns upstream rewrite rules of registries
+func (c *Config) Rewriter() (*upstream.Rewriter, error) {
+	var rules []string
+	for name, r := range c.Registries {
+		if len(r.Upstreams) != 0 {
+			rules = append(rules, name+"="+strings.Join(r.Upstreams, ","))
+		}
+	}
+	return upstream.NewRewriter(rules)
+}
+
+// Limits returns rate limits of registries
+func (c *Config) Limits() []upstream.Limit {
+	var res []upstream.Limit
+	for name, r := range c.Registries {
+		if r.RateLimit != nil {
+			burst := max(r.RateLimit.Burst, 1)
+			res = append(res, upstream.Limit{Upstream: name, RPS: r.RateLimit.RPS, Burst: burst})
+		}
+	}
+	return res
+}
+
+// canonicalKey returns registry or registry/repo prefix with registry alias resolved
+func canonicalKey(name string) string {
+	registry, repository, ok := strings.Cut(name, "/")
+	if !ok {
+		return model.CanonicalRegistry(name)
+	}
+	return model.CanonicalRegistry(registry) + "/" + repository
+}
+
+// PrivateRegistries returns registries to skip manifests caching for
+func (c *Config) PrivateRegistries() map[string]bool {
+	res := map[string]bool{}
+	for name, r := range c.Registries {
+		if r.Private {
+			res[canonicalKey(name)] = true
+		}
+	}
+	return res
+}
+
+// ManifestTTLs returns per-registry manifest TTL overrides
+func (c *Config) ManifestTTLs() map[string]time.Duration {
+	res := map[string]time.Duration{}
+	for name, r := range c.Registries {
+		if r.ManifestTTL > 0 {
+			res[canonicalKey(name)] = r.ManifestTTL
+		}
+	}
+	return res
+}
+
+// Retentions returns GC retention overrides by registry or registry/repo prefix
+func (c *Config) Retentions() map[string]time.Duration {
+	res := map[string]time.Duration{}
+	for name, r := range c.Registries {
+		if r.Retention > 0 {
+			res[canonicalKey(name)] = r.Retention
+		}
+	}
+	return res
+}
+
+// Registry returns settings of registry, creating it if needed
+func (c *Config) Registry(name string) Registry {
+	if c.Registries == nil {
+		c.Registries = map[string]Registry{}
+	}
+	return c.Registries[name]
+}
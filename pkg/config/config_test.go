@@ -0,0 +1,213 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+	"github.com/sepich/containerd-registry-cache/pkg/service"
+	"github.com/sepich/containerd-registry-cache/pkg/upstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func baseConfig() *Config {
+	return &Config{
+		Storage: Storage{CacheDir: "/tmp/data"},
+		Policy:  Policy{SkipTags: "latest", CacheManifests: true},
+	}
+}
+
+func TestDecode(t *testing.T) {
+	cfg := baseConfig()
+	err := Decode([]byte(`
+policy:
+  skipTags: "^(latest|main)$"
+  manifestTTL: 1h
+upstream:
+  cooldown: 1m
+registries:
+  docker.io:
+    upstreams: [mirror.gcr.io, registry-1.docker.io]
+  registry-1.docker.io:
+    rateLimit: {rps: 0.1, burst: 20}
+  ghcr.io/private:
+    private: true
+  quay.io:
+    retention: 168h
+gc:
+  interval: 12h
+  retention: 720h
+scrub:
+  interval: 168h
+  rateMB: 5
+credentials:
+  registry-1.docker.io:
+    username: user
+    password: pass
+`), cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Validate())
+
+	assert.Equal(t, "/tmp/data", cfg.Storage.CacheDir, "not set in file")
+	assert.True(t, cfg.Policy.CacheManifests, "not set in file")
+	assert.Equal(t, "^(latest|main)$", cfg.Policy.SkipTags)
+	assert.Equal(t, time.Hour, cfg.Policy.ManifestTTL)
+	assert.Equal(t, time.Minute, cfg.Upstream.Cooldown)
+	assert.Equal(t, map[string]bool{"ghcr.io/private": true}, cfg.PrivateRegistries())
+	private, _ := model.MatchPrefix(cfg.PrivateRegistries(), "ghcr.io", "private/app")
+	assert.True(t, private, "matched by prefix")
+	private, _ = model.MatchPrefix(cfg.PrivateRegistries(), "ghcr.io", "privateer/app")
+	assert.False(t, private)
+	assert.Equal(t, GC{Interval: 12 * time.Hour, Retention: 720 * time.Hour}, cfg.GC)
+	assert.Equal(t, Scrub{Interval: 168 * time.Hour, RateMB: 5}, cfg.Scrub)
+	assert.Equal(t, map[string]time.Duration{"quay.io": 168 * time.Hour}, cfg.Retentions())
+	assert.Equal(t, []upstream.Limit{{Upstream: "registry-1.docker.io", RPS: 0.1, Burst: 20}}, cfg.Limits())
+	assert.Equal(t, service.RegistryCreds{Username: "user", Password: "pass"}, cfg.Credentials["registry-1.docker.io"])
+
+	rewriter, err := cfg.Rewriter()
+	assert.NoError(t, err)
+	assert.Equal(t, []upstream.Target{{Registry: "mirror.gcr.io", Repository: "library/alpine"}, {Registry: "registry-1.docker.io", Repository: "library/alpine"}}, rewriter.Resolve("docker.io", "library/alpine"))
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		name string
+		yaml string
+	}{
+		{"unknown field", "policy:\n  skipTag: latest"},
+		{"wrong type", "policy:\n  cacheManifests: maybe"},
+		{"bad duration", "policy:\n  manifestTTL: 1 hour"},
+		{"bad regexp", "policy:\n  skipTags: '('"},
+		{"bad rate limit", "registries:\n  ghcr.io:\n    rateLimit: {rps: 0}"},
+		{"rate limit by repository", "registries:\n  ghcr.io/org:\n    rateLimit: {rps: 1}"},
+		{"bad ecr account", "ecr:\n  roles:\n    abcdefghijkl: arn:aws:iam::123456789012:role/x"},
+		{"bad upstream", "registries:\n  ghcr.io:\n    upstreams: ['']"},
+		{"negative retention", "gc:\n  retention: -1h"},
+		{"negative verify size", "policy:\n  verifyMaxKB: -1"},
+		{"bad metadata", "storage:\n  metadata: db"},
+		{"bad creds", "credentials:\n  ghcr.io:\n    username: user"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := baseConfig()
+			err := Decode([]byte(tc.yaml), cfg)
+			if err == nil {
+				err = cfg.Validate()
+			}
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestReloadKeepsLastGood(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	credsFile := filepath.Join(dir, "creds.yaml")
+	assert.NoError(t, os.WriteFile(configFile, []byte("policy:\n  skipTags: main\n"), 0600))
+	assert.NoError(t, os.WriteFile(credsFile, []byte("ghcr.io:\n  username: user\n  password: pass1\n"), 0600))
+
+	var applied *Config
+	r := &Reloader{
+		ConfigFile: configFile,
+		CredsFiles: []string{credsFile},
+		Base:       baseConfig,
+		Apply:      func(cfg *Config) { applied = cfg },
+		Logger:     slog.Default(),
+	}
+	assert.NoError(t, r.Reload())
+	assert.Equal(t, "main", applied.Policy.SkipTags)
+	assert.Equal(t, "pass1", applied.Credentials["ghcr.io"].Password)
+	assert.False(t, r.changed())
+
+	// password rotation
+	assert.NoError(t, os.WriteFile(credsFile, []byte("ghcr.io:\n  username: user\n  password: pass2\n"), 0600))
+	assert.True(t, r.changed())
+	assert.NoError(t, r.Reload())
+	assert.Equal(t, "pass2", applied.Credentials["ghcr.io"].Password)
+
+	// invalid config is rejected
+	assert.NoError(t, os.WriteFile(configFile, []byte("policy:\n  skipTags: '('\n"), 0600))
+	assert.Error(t, r.Reload())
+	assert.Equal(t, "main", applied.Policy.SkipTags)
+	assert.False(t, r.changed(), "failed attempt should not be retried until files change")
+
+	// unreadable config
+	assert.NoError(t, os.Remove(configFile))
+	assert.True(t, r.changed())
+	assert.ErrorContains(t, r.Reload(), "could not read config file")
+	assert.False(t, r.changed(), "failed attempt should not be retried until files change")
+}
+
+func TestParseCreds(t *testing.T) {
+	creds, err := ParseCreds([]byte(`{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "dXNlcjpwYTpzcw=="},
+			"myregistry.azurecr.io": {"auth": "MDAwMDAwMDAtMDAwMC0wMDAwLTAwMDAtMDAwMDAwMDAwMDAwOg==", "identitytoken": "refresh"},
+			"ghcr.io": {"username": "user", "password": "pass"},
+			"registry.example.com": {"registrytoken": "bearer"}
+		}
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]service.RegistryCreds{
+		"registry-1.docker.io":  {Username: "user", Password: "pa:ss"},
+		"myregistry.azurecr.io": {IdentityToken: "refresh"},
+		"ghcr.io":               {Username: "user", Password: "pass"},
+		"registry.example.com":  {Token: "bearer"},
+	}, creds)
+
+	creds, err = ParseCreds([]byte("europe-west3-docker.pkg.dev/project:\n  username: _json_key\n  password: secret\nghcr.io:\n  token: bearer\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]service.RegistryCreds{
+		"europe-west3-docker.pkg.dev/project": {Username: "_json_key", Password: "secret"},
+		"ghcr.io":                             {Token: "bearer"},
+	}, creds)
+
+	_, err = ParseCreds([]byte(`{"auths": {"ghcr.io": {"auth": "invalid"}}}`))
+	assert.Error(t, err)
+}
+
+func TestParseCredHelpers(t *testing.T) {
+	creds, err := ParseCreds([]byte(`{"credHelpers": {"123.dkr.ecr.eu-west-1.amazonaws.com": "ecr-login"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]service.RegistryCreds{"123.dkr.ecr.eu-west-1.amazonaws.com": {Helper: "ecr-login"}}, creds)
+
+	// ~/.docker/config.json after `docker login` with credsStore
+	creds, err = ParseCreds([]byte(`{
+		"auths": {"ghcr.io": {}, "https://index.docker.io/v1/": {}},
+		"credsStore": "desktop",
+		"credHelpers": {"gcr.io": "gcloud"}
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]service.RegistryCreds{
+		"ghcr.io":              {Helper: "desktop"},
+		"registry-1.docker.io": {Helper: "desktop"},
+		"gcr.io":               {Helper: "gcloud"},
+	}, creds)
+	cfg := &Config{Credentials: creds}
+	cfg.Storage.CacheDir = "/tmp/data"
+	assert.NoError(t, cfg.Validate())
+
+	creds, err = ParseCreds([]byte(`{"auths": {"ghcr.io": {}}}`))
+	assert.NoError(t, err)
+	assert.Empty(t, creds)
+
+	creds, err = ParseCreds([]byte(`
+europe-docker.pkg.dev:
+  helper: gcloud
+ecr.example.com:
+  provider:
+    command: /usr/local/bin/ecr-credential-provider
+    args: [get-credentials]
+    apiVersion: credentialprovider.kubelet.k8s.io/v1
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "gcloud", creds["europe-docker.pkg.dev"].Helper)
+	assert.Equal(t, &service.ExecProvider{
+		Command:    "/usr/local/bin/ecr-credential-provider",
+		Args:       []string{"get-credentials"},
+		APIVersion: "credentialprovider.kubelet.k8s.io/v1",
+	}, creds["ecr.example.com"].Provider)
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+
+	"github.com/sepich/containerd-registry-cache/pkg/service"
+	"gopkg.in/yaml.v3"
+)
+
+// dockerConfig is the format of ~/.docker/config.json and `kubernetes.io/dockerconfigjson` secrets
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+	CredsStore  string                `json:"credsStore"`
+}
+
+type dockerAuth struct {
+	Auth          string `json:"auth"` // base64 of `username:password`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+// ReadCreds reads registry credentials files in order, later files override keys of the previous ones
+func ReadCreds(credsFiles ...string) (map[string]service.RegistryCreds, error) {
+	res := map[string]service.RegistryCreds{}
+	for _, f := range credsFiles {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not read registry credentials file: %w", err)
+		}
+		creds, err := ParseCreds(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse registry credentials file `%s`: %w", f, err)
+		}
+		maps.Copy(res, creds)
+	}
+	return res, nil
+}
+
+// ParseCreds parses credentials in yaml format keyed by registry host (and path prefix),
+// or in dockerconfigjson format with `auths` and `credHelpers` sections
+func ParseCreds(data []byte) (map[string]service.RegistryCreds, error) {
+	var probe map[string]json.RawMessage
+	if json.Unmarshal(data, &probe) == nil && (probe["auths"] != nil || probe["credHelpers"] != nil) {
+		return parseDockerConfig(data)
+	}
+
+	res := map[string]service.RegistryCreds{}
+	if err := yaml.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func parseDockerConfig(data []byte) (map[string]service.RegistryCreds, error) {
+	cfg := dockerConfig{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	res := map[string]service.RegistryCreds{}
+	for host, a := range cfg.Auths {
+		if a.Auth == "" && a.Username == "" && a.IdentityToken == "" && a.RegistryToken == "" {
+			// `docker login` with credsStore leaves empty entry, the secret is in the store
+			if cfg.CredsStore != "" {
+				res[normalizeHost(host)] = service.RegistryCreds{Helper: cfg.CredsStore}
+			}
+			continue
+		}
+		creds := service.RegistryCreds{
+			Username:      a.Username,
+			Password:      a.Password,
+			IdentityToken: a.IdentityToken,
+			Token:         a.RegistryToken,
+		}
+		if a.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth for `%s`: %w", host, err)
+			}
+			user, pass, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid auth for `%s`: expected base64 of `username:password`", host)
+			}
+			creds.Username, creds.Password = user, pass
+		}
+		if creds.IdentityToken != "" {
+			creds.Username, creds.Password = "", "" // `<token>` placeholder
+		}
+		res[normalizeHost(host)] = creds
+	}
+	for host, helper := range cfg.CredHelpers {
+		res[normalizeHost(host)] = service.RegistryCreds{Helper: helper}
+	}
+	return res, nil
+}
+
+// normalizeHost converts docker config keys like `https://index.docker.io/v1/` to registry host
+func normalizeHost(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key = strings.TrimSuffix(key, "/")
+	key = strings.TrimSuffix(strings.TrimSuffix(key, "/v1"), "/v2")
+	switch key {
+	case "index.docker.io", "docker.io":
+		return "registry-1.docker.io"
+	}
+	return key
+}
@@ -0,0 +1,162 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var configGeneration = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "containerd_cache_config_generation",
+	Help: "Number of configurations applied since start",
+})
+var configReloadSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "containerd_cache_config_last_reload_successful",
+	Help: "Whether the last configuration reload attempt was successful",
+})
+var configReloadTime = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "containerd_cache_config_last_reload_success_timestamp_seconds",
+	Help: "Timestamp of the last successful configuration reload",
+})
+
+// Reloader loads configuration from flags, config file and credentials file, and applies it on changes
+type Reloader struct {
+	ConfigFile string
+	CredsFiles []string
+	Base       func() *Config // settings from flags, to be overridden by the config file
+	Apply      func(*Config)  // called with validated config
+	Logger     *slog.Logger
+
+	mu   sync.Mutex
+	hash [sha256.Size]byte // of files content last loaded
+}
+
+// Load reads and validates configuration
+func (r *Reloader) Load() (*Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg, sum, err := r.load()
+	r.hash = sum
+	return cfg, err
+}
+
+// Init applies cfg returned by Load at startup, without loading it again. Reloads apply changes made since Load.
+func (r *Reloader) Init(cfg *Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.apply(cfg)
+}
+
+func (r *Reloader) load() (*Config, [sha256.Size]byte, error) {
+	cfg := r.Base()
+	// hashed the same way as in changed, so that a failed attempt is not retried until files change
+	h := sha256.New()
+	var data []byte
+	var readErr error
+	if r.ConfigFile != "" {
+		data, readErr = os.ReadFile(r.ConfigFile)
+		h.Write(data)
+	}
+	for _, f := range r.CredsFiles {
+		data, _ := os.ReadFile(f)
+		h.Write(data)
+	}
+	sum := [sha256.Size]byte(h.Sum(nil))
+
+	if readErr != nil {
+		return nil, sum, fmt.Errorf("could not read config file: %w", readErr)
+	}
+	if r.ConfigFile != "" {
+		if err := Decode(data, cfg); err != nil {
+			return nil, sum, fmt.Errorf("could not parse config file: %w", err)
+		}
+	}
+
+	creds, err := ReadCreds(r.CredsFiles...)
+	if err != nil {
+		return nil, sum, err
+	}
+	// credentials from the config file take precedence
+	maps.Copy(creds, cfg.Credentials)
+	cfg.Credentials = creds
+
+	if err = cfg.Validate(); err != nil {
+		return nil, sum, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, sum, nil
+}
+
+// Reload loads configuration and applies it. On error the last good configuration stays in effect.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, sum, err := r.load()
+	r.hash = sum
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+	r.apply(cfg)
+	return nil
+}
+
+func (r *Reloader) apply(cfg *Config) {
+	r.Apply(cfg)
+	configGeneration.Inc()
+	configReloadSuccess.Set(1)
+	configReloadTime.SetToCurrentTime()
+}
+
+// changed returns true if content of the files differs from the last loaded
+func (r *Reloader) changed() bool {
+	h := sha256.New()
+	for _, f := range append([]string{r.ConfigFile}, r.CredsFiles...) {
+		if f != "" {
+			data, _ := os.ReadFile(f)
+			h.Write(data)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return [sha256.Size]byte(h.Sum(nil)) != r.hash
+}
+
+// Watch reloads configuration on SIGHUP, or when the files content changes (checked every interval).
+// Content is compared instead of mtime to support k8s ConfigMap/Secret symlink swaps.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.Logger.Info("Received SIGHUP, reloading config")
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			r.Logger.Info("Config files changed, reloading config")
+		}
+		if err := r.Reload(); err != nil {
+			r.Logger.Error("Could not reload config, keeping the last good one", "error", err)
+		} else {
+			r.Logger.Info("Config reloaded")
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+	"github.com/sepich/containerd-registry-cache/pkg/usage"
+)
+
+var deletedObjects = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "containerd_cache_gc_deleted_objects_total",
+	Help: "Objects deleted by garbage collection",
+}, []string{"type"})
+
+var deletedBytes = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "containerd_cache_gc_deleted_bytes_total",
+	Help: "Bytes deleted by garbage collection",
+})
+
+var lastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "containerd_cache_gc_last_success_timestamp_seconds",
+	Help: "Timestamp of the last successful garbage collection by this replica",
+})
+
+// reportName is the report of the last run by any replica sharing the cache
+const reportName = "gc/report.json"
+
+// startedName is written at start of scheduled runs (including dry ones) by any replica sharing the cache,
+// to run only once per interval
+const startedName = "gc/started"
+
+// maxReportKeys limits deleted keys listed in the report
+const maxReportKeys = 1000
+
+// checkInterval to check whether the next run is due
+const checkInterval = time.Minute
+
+var ErrRunning = errors.New("garbage collection is already running")
+
+// Policy could be changed at runtime
+type Policy struct {
+	Interval   time.Duration            // between scheduled runs, 0 to disable them
+	Retention  time.Duration            // delete manifests and unreferenced blobs not accessed for this, 0 to disable GC
+	Registries map[string]time.Duration // manifest retention overrides by registry or registry/repo prefix
+	DryRun     bool                     // only report scheduled runs
+}
+
+func (p Policy) retention(registry, repository string) time.Duration {
+	if r, ok := model.MatchPrefix(p.Registries, registry, repository); ok {
+		return r
+	}
+	return p.Retention
+}
+
+type Stats struct {
+	Total        int   `json:"total"`
+	Live         int   `json:"live"`
+	Deleted      int   `json:"deleted"`
+	DeletedBytes int64 `json:"deletedBytes"`
+}
+
+type Report struct {
+	Replica   string    `json:"replica"`
+	Started   time.Time `json:"started"`
+	Duration  string    `json:"duration"`
+	DryRun    bool      `json:"dryRun"`
+	Manifests Stats     `json:"manifests"`
+	Blobs     Stats     `json:"blobs"`
+	Errors    int       `json:"errors"`
+	Deleted   []string  `json:"deleted,omitempty"` // keys of deleted objects, or to be deleted on dry run
+}
+
+func (r *Report) deleted(o cache.ObjectInfo) {
+	s := &r.Blobs
+	if o.Type == model.ObjectTypeManifest {
+		s = &r.Manifests
+	}
+	s.Deleted++
+	s.DeletedBytes += o.Size
+	if len(r.Deleted) < maxReportKeys {
+		r.Deleted = append(r.Deleted, o.Key)
+	}
+}
+
+// Collector is a mark-and-sweep garbage collector. Manifests not accessed for the retention are expired, the rest
+// are roots marking referenced platform manifests and blobs as live. Expired manifests not referenced by live ones,
+// and blobs neither referenced nor accessed for the retention are deleted. So layers shared with retained images
+// are kept, as well as blobs of images with manifests skipped from caching.
+type Collector struct {
+	Store   cache.Store
+	Usage   *usage.Index // last access of objects, optional, otherwise modification time is used
+	Replica string
+	Logger  *slog.Logger
+
+	policy  atomic.Pointer[Policy]
+	running sync.Mutex
+}
+
+func (c *Collector) SetPolicy(p Policy) {
+	c.policy.Store(&p)
+}
+
+// Run starts scheduled collections until ctx is done. Only one replica sharing the cache runs it per interval.
+func (c *Collector) Run(ctx context.Context) {
+	t := time.NewTicker(checkInterval)
+	defer t.Stop()
+	for {
+		c.runDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// runDue runs collection if the last one by any replica was started more than the interval ago
+func (c *Collector) runDue(ctx context.Context) {
+	p := c.policy.Load()
+	if p == nil || p.Interval <= 0 || p.Retention <= 0 {
+		return
+	}
+	last, err := c.lastRun(ctx)
+	if err != nil {
+		c.Logger.Warn("Could not check last garbage collection", "error", err)
+		return
+	}
+	if time.Since(last) < p.Interval {
+		return
+	}
+	// replicas checking at the same time could both run, which is only extra work
+	if err := c.Store.WriteMeta(ctx, startedName, []byte(c.Replica)); err != nil {
+		c.Logger.Warn("Could not mark garbage collection started", "error", err)
+		return
+	}
+	if _, err := c.Collect(ctx, p.DryRun); err != nil && !errors.Is(err, ErrRunning) {
+		c.Logger.Error("Garbage collection failed", "error", err)
+	}
+}
+
+func (c *Collector) lastRun(ctx context.Context) (time.Time, error) {
+	files, err := c.Store.ListMeta(ctx, startedName)
+	if err != nil || len(files) == 0 {
+		return time.Time{}, err
+	}
+	return files[0].ModTime, nil
+}
+
+// LastReport returns report of the last run by any replica, nil if there was none
+func (c *Collector) LastReport(ctx context.Context) (*Report, error) {
+	data, err := c.Store.ReadMeta(ctx, reportName)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{}
+	return r, json.Unmarshal(data, r)
+}
+
+// Collect runs garbage collection with the current policy, dryRun only reports objects to be deleted
+func (c *Collector) Collect(ctx context.Context, dryRun bool) (*Report, error) {
+	p := c.policy.Load()
+	if p == nil || p.Retention <= 0 {
+		return nil, errors.New("garbage collection is disabled, set retention to enable")
+	}
+	if !c.running.TryLock() {
+		return nil, ErrRunning
+	}
+	defer c.running.Unlock()
+
+	r := &Report{Replica: c.Replica, Started: time.Now(), DryRun: dryRun}
+	c.Logger.Info("Garbage collection started", "dryRun", dryRun, "retention", p.Retention)
+
+	var access map[string]*usage.Entry
+	if c.Usage != nil {
+		var err error
+		if access, err = c.Usage.Entries(ctx); err != nil {
+			return nil, err
+		}
+	}
+	lastAccess := func(o cache.ObjectInfo) time.Time {
+		if e, ok := access[o.Key]; ok && e.LastAccess.After(o.ModTime) {
+			return e.LastAccess
+		}
+		return o.ModTime
+	}
+
+	var manifests, blobs []cache.ObjectInfo
+	err := c.Store.Walk(ctx, func(o cache.ObjectInfo) error {
+		if o.Orphan {
+			return nil // left for the scrubber
+		}
+		if o.Type == model.ObjectTypeManifest {
+			manifests = append(manifests, o)
+		} else {
+			blobs = append(blobs, o)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.Manifests.Total, r.Blobs.Total = len(manifests), len(blobs)
+
+	// mark
+	live := map[string]bool{}
+	var queue []model.ObjectIdentifier
+	expired := map[string]bool{}
+	for _, o := range manifests {
+		if r.Started.Sub(lastAccess(o)) > p.retention(o.Registry, o.Repository) {
+			expired[o.Key] = true
+			continue
+		}
+		live[o.Key] = true
+		queue = append(queue, o.ObjectIdentifier)
+	}
+	var markErrors int
+	for len(queue) != 0 {
+		object := queue[0]
+		queue = queue[1:]
+		refs, err := c.references(ctx, &object)
+		if err != nil {
+			c.Logger.Warn("Could not read manifest references", "registry", object.Registry, "repository", object.Repository, "ref", object.Ref, "error", err)
+			markErrors++
+			continue
+		}
+		for _, ref := range refs {
+			key := cache.ObjectToCacheName(&ref)
+			if live[key] {
+				continue
+			}
+			live[key] = true
+			if ref.Type == model.ObjectTypeManifest {
+				queue = append(queue, ref)
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// sweep
+	var deleted []string
+	del := func(o cache.ObjectInfo) {
+		if !dryRun {
+			if err := c.Store.Delete(ctx, o.Key); err != nil {
+				c.Logger.Warn("Could not delete object", "key", o.Key, "error", err)
+				r.Errors++
+				return
+			}
+			deletedObjects.WithLabelValues(string(o.Type)).Inc()
+			deletedBytes.Add(float64(o.Size))
+			deleted = append(deleted, o.Key)
+		}
+		r.deleted(o)
+	}
+	for _, o := range manifests {
+		if live[o.Key] {
+			r.Manifests.Live++
+		} else if expired[o.Key] {
+			del(o)
+		}
+	}
+	for _, o := range blobs {
+		if live[o.Key] {
+			r.Blobs.Live++
+			continue
+		}
+		// unreadable manifest could reference any blob
+		if markErrors == 0 && r.Started.Sub(lastAccess(o)) > p.Retention {
+			del(o)
+		}
+	}
+	r.Errors += markErrors
+	if c.Usage != nil && len(deleted) != 0 {
+		c.Usage.Remove(deleted...)
+	}
+	r.Duration = time.Since(r.Started).Round(time.Millisecond).String()
+
+	c.Logger.Info("Garbage collection finished", "dryRun", dryRun, "duration", r.Duration,
+		"manifests", r.Manifests.Total, "blobs", r.Blobs.Total, "errors", r.Errors,
+		"deletedManifests", r.Manifests.Deleted, "deletedBlobs", r.Blobs.Deleted, "deletedBytes", r.Manifests.DeletedBytes+r.Blobs.DeletedBytes)
+	if markErrors != 0 {
+		c.Logger.Warn("Blobs were not collected due to unreadable manifests", "errors", markErrors)
+	}
+	if !dryRun {
+		lastSuccess.SetToCurrentTime()
+		if data, err := json.Marshal(r); err == nil {
+			if err := c.Store.WriteMeta(ctx, reportName, data); err != nil {
+				c.Logger.Warn("Could not save garbage collection report", "error", err)
+			}
+		}
+	}
+	return r, nil
+}
+
+func (c *Collector) references(ctx context.Context, object *model.ObjectIdentifier) ([]model.ObjectIdentifier, error) {
+	body, err := cache.ReadObject(ctx, c.Store, object, model.MaxManifestSize)
+	if err != nil || body == nil {
+		return nil, err // deleted meanwhile
+	}
+	return model.ManifestReferences(*object, body)
+}
@@ -0,0 +1,127 @@
+package gc
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/cache/cachetest"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func digest(c byte) string {
+	return "sha256:" + strings.Repeat(string(c), 64)
+}
+
+func manifest(registry, ref string) model.ObjectIdentifier {
+	return model.ObjectIdentifier{Registry: registry, Repository: "app", Ref: ref, Type: model.ObjectTypeManifest}
+}
+
+func blob(c byte) model.ObjectIdentifier {
+	return model.ObjectIdentifier{Ref: digest(c), Type: model.ObjectTypeBlob}
+}
+
+func TestCollect(t *testing.T) {
+	ctx := context.Background()
+	c := &cache.FileCache{CacheDirectory: t.TempDir()}
+	day := 24 * time.Hour
+
+	// recent tag of multi-arch image, with old platform manifest and layers
+	cachetest.PutAged(t, c, manifest("docker.io", "v2"), `{"manifests":[{"digest":"`+digest('1')+`"}]}`, time.Hour)
+	platform := cachetest.PutAged(t, c, manifest("docker.io", digest('1')), `{"config":{"digest":"`+digest('a')+`"},"layers":[{"digest":"`+digest('b')+`"}]}`, 60*day)
+	config := cachetest.PutAged(t, c, blob('a'), "config", 60*day)
+	shared := cachetest.PutAged(t, c, blob('b'), "shared layer", 60*day)
+	// expired tag, sharing a layer
+	expired := cachetest.PutAged(t, c, manifest("docker.io", "v1"), `{"layers":[{"digest":"`+digest('b')+`"},{"digest":"`+digest('c')+`"}]}`, 40*day)
+	unique := cachetest.PutAged(t, c, blob('c'), "unique layer", 40*day)
+	// blob of image with manifest skipped from caching
+	recent := cachetest.PutAged(t, c, blob('d'), "latest", day)
+	// longer retention for the registry
+	retained := cachetest.PutAged(t, c, manifest("quay.io", "v1"), `{}`, 40*day)
+
+	collector := &Collector{Store: c, Logger: slog.New(slog.DiscardHandler)}
+	_, err := collector.Collect(ctx, false)
+	assert.Error(t, err, "disabled without retention")
+	collector.SetPolicy(Policy{Retention: 30 * day, Registries: map[string]time.Duration{"quay.io": 90 * day}})
+
+	report, err := collector.Collect(ctx, true)
+	assert.NoError(t, err)
+	assert.Equal(t, Stats{Total: 4, Live: 3, Deleted: 1, DeletedBytes: int64(len(`{"layers":[{"digest":"` + digest('b') + `"},{"digest":"` + digest('c') + `"}]}`))}, report.Manifests)
+	assert.Equal(t, Stats{Total: 4, Live: 2, Deleted: 1, DeletedBytes: int64(len("unique layer"))}, report.Blobs)
+	assert.ElementsMatch(t, []string{expired, unique}, report.Deleted)
+	assert.FileExists(t, filepath.Join(c.CacheDirectory, expired), "dry run")
+	_, err = collector.LastReport(ctx)
+	assert.ErrorIs(t, err, os.ErrNotExist, "dry run is not saved")
+
+	report, err = collector.Collect(ctx, false)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{expired, unique}, report.Deleted)
+	for _, key := range []string{expired, unique} {
+		assert.NoFileExists(t, filepath.Join(c.CacheDirectory, key))
+		assert.NoFileExists(t, filepath.Join(c.CacheDirectory, key+".json"))
+	}
+	for _, key := range []string{platform, config, shared, recent, retained} {
+		assert.FileExists(t, filepath.Join(c.CacheDirectory, key))
+	}
+	last, err := collector.LastReport(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, report.Deleted, last.Deleted)
+
+	// unreadable manifest could reference any blob
+	cachetest.PutAged(t, c, manifest("docker.io", "broken"), `{`, time.Hour)
+	cachetest.PutAged(t, c, blob('e'), "orphan", 40*day)
+	report, err = collector.Collect(ctx, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Errors)
+	assert.Empty(t, report.Deleted)
+}
+
+func TestRetention(t *testing.T) {
+	day := 24 * time.Hour
+	p := Policy{Retention: day, Registries: map[string]time.Duration{"quay.io": 2 * day, "quay.io/org/app": 3 * day}}
+	assert.Equal(t, 3*day, p.retention("quay.io", "org/app/sub"))
+	assert.Equal(t, 2*day, p.retention("quay.io", "org/application"))
+	assert.Equal(t, day, p.retention("docker.io", "org/app"))
+}
+
+func TestRun(t *testing.T) {
+	c := &cache.FileCache{CacheDirectory: t.TempDir()}
+	day := 24 * time.Hour
+	old := cachetest.PutAged(t, c, blob('a'), "old", 40*day)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &Collector{Store: c, Replica: "a", Logger: slog.New(slog.DiscardHandler)}
+	a.SetPolicy(Policy{Interval: time.Hour, Retention: 30 * day, DryRun: true})
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		last, err := a.lastRun(ctx)
+		return err == nil && !last.IsZero()
+	}, time.Second, 10*time.Millisecond, "dry run is marked too")
+	cancel()
+	<-done
+	assert.FileExists(t, filepath.Join(c.CacheDirectory, old))
+
+	// another replica skips the interval
+	b := &Collector{Store: c, Replica: "b", Logger: slog.New(slog.DiscardHandler)}
+	b.SetPolicy(Policy{Interval: time.Hour, Retention: 30 * day})
+	b.runDue(context.Background())
+	assert.FileExists(t, filepath.Join(c.CacheDirectory, old))
+
+	started := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(filepath.Join(c.CacheDirectory, "_meta", startedName), started, started))
+	b.runDue(context.Background())
+	assert.NoFileExists(t, filepath.Join(c.CacheDirectory, old))
+	report, err := b.LastReport(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "b", report.Replica)
+}
@@ -0,0 +1,196 @@
+// Package migrate copies cache content between backends, like from FileCache on PVC to S3Cache
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+)
+
+// progressInterval to log progress of long migrations
+const progressInterval = 30 * time.Second
+
+var errCorrupt = errors.New("source object is corrupt")
+
+type Stats struct {
+	Objects int   `json:"objects"`
+	Copied  int   `json:"copied"`
+	Skipped int   `json:"skipped"` // already in destination, by the previous run
+	Corrupt int   `json:"corrupt"` // not matching its digest in source, left to be fetched from upstream
+	Orphans int   `json:"orphans"`
+	Errors  int   `json:"errors"`
+	Bytes   int64 `json:"bytes"` // copied
+}
+
+// Migrator copies every object from Src to Dst via the reader and writer of the backends, so metadata is translated
+// between FileCache sidecar and S3 object metadata. Objects already in Dst with the same size and digest are
+// skipped, so interrupted migration could be resumed by running it again. Content is verified against its digest
+// while copying. Cache date is not preserved, as S3 uses object modification time for it.
+type Migrator struct {
+	Src     cache.Store
+	Dst     cache.CachingService
+	Workers int  // objects copied in parallel
+	Verify  bool // read objects back from Dst after copy, to verify them
+	Logger  *slog.Logger
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+func (m *Migrator) Run(ctx context.Context) (*Stats, error) {
+	objects := make(chan cache.ObjectInfo)
+	var wg sync.WaitGroup
+	for range max(m.Workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for o := range objects {
+				m.migrate(ctx, o)
+			}
+		}()
+	}
+
+	start, last := time.Now(), time.Now()
+	err := m.Src.Walk(ctx, func(o cache.ObjectInfo) error {
+		if time.Since(last) > progressInterval {
+			last = time.Now()
+			s := m.Stats()
+			m.Logger.Info("Migration in progress", "duration", time.Since(start).Round(time.Second), "objects", s.Objects,
+				"copied", s.Copied, "skipped", s.Skipped, "errors", s.Errors, "bytes", s.Bytes)
+		}
+		select {
+		case objects <- o:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(objects)
+	wg.Wait()
+	s := m.Stats()
+	if err != nil {
+		return &s, err
+	}
+	if err := ctx.Err(); err != nil {
+		return &s, err
+	}
+	return &s, nil
+}
+
+func (m *Migrator) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+func (m *Migrator) migrate(ctx context.Context, o cache.ObjectInfo) {
+	result, n, err := m.copy(ctx, o)
+	if err != nil && ctx.Err() == nil {
+		level := slog.LevelError
+		if result == "corrupt" {
+			level = slog.LevelWarn
+		}
+		m.Logger.Log(ctx, level, "Could not migrate object", "key", o.Key, "error", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.Objects++
+	switch result {
+	case "copied":
+		m.stats.Copied++
+		m.stats.Bytes += n
+	case "skipped":
+		m.stats.Skipped++
+	case "corrupt":
+		m.stats.Corrupt++
+	case "orphan":
+		m.stats.Orphans++
+	default:
+		m.stats.Errors++
+	}
+}
+
+// copy returns result of the object: copied, skipped, corrupt, orphan or error, with bytes copied
+func (m *Migrator) copy(ctx context.Context, o cache.ObjectInfo) (string, int64, error) {
+	if o.Orphan {
+		return "orphan", 0, nil // never served
+	}
+	src, _, err := m.Src.GetCache(ctx, &o.ObjectIdentifier)
+	if err != nil {
+		return "error", 0, err
+	}
+	if src == nil {
+		return "orphan", 0, nil // removed meanwhile
+	}
+	meta := src.GetMetadata()
+	meta.ObjectIdentifier = o.ObjectIdentifier
+	expected := cache.ExpectedDigest(meta)
+
+	dst, w, err := m.Dst.GetCache(ctx, &o.ObjectIdentifier)
+	if err != nil {
+		return "error", 0, err
+	}
+	if dst != nil && dst.GetMetadata().SizeBytes == meta.SizeBytes && dst.GetMetadata().DockerContentDigest == meta.DockerContentDigest {
+		return "skipped", 0, nil
+	}
+	defer w.Cleanup()
+
+	r, err := src.GetReader(ctx)
+	if err != nil {
+		return "error", 0, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	n, err := io.Copy(w, io.TeeReader(r, h))
+	if err != nil {
+		return "error", n, err
+	}
+	actual := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if expected != "" && actual != expected {
+		return "corrupt", n, fmt.Errorf("%w, expected %s, actual %s", errCorrupt, expected, actual)
+	}
+	if n != meta.SizeBytes {
+		return "corrupt", n, fmt.Errorf("%w, expected size %d, actual %d", errCorrupt, meta.SizeBytes, n)
+	}
+	if err := w.Close(ctx, meta.ContentType, meta.DockerContentDigest); err != nil {
+		return "error", n, err
+	}
+	if m.Verify {
+		if err := m.verify(ctx, o, actual); err != nil {
+			return "error", n, err
+		}
+	}
+	return "copied", n, nil
+}
+
+// verify reads object back from Dst
+func (m *Migrator) verify(ctx context.Context, o cache.ObjectInfo, digest string) error {
+	dst, _, err := m.Dst.GetCache(ctx, &o.ObjectIdentifier)
+	if err != nil {
+		return err
+	}
+	if dst == nil {
+		return errors.New("object is missing in destination after copy")
+	}
+	r, err := dst.GetReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return fmt.Errorf("destination object does not match source, expected %s, actual %s", digest, actual)
+	}
+	return nil
+}
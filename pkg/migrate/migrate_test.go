@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/cache/cachetest"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	src := &cache.FileCache{CacheDirectory: t.TempDir()}
+	dst := &cache.FileCache{CacheDirectory: t.TempDir()}
+
+	tag := model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: "3.20", Type: model.ObjectTypeManifest}
+	cachetest.Put(t, src, tag, `{}`, "application/vnd.oci.image.index.v1+json", cachetest.Digest(`{}`))
+	untagged := model.ObjectIdentifier{Registry: "ghcr.io", Repository: "org/app", Ref: "v1", Type: model.ObjectTypeManifest}
+	cachetest.Put(t, src, untagged, `{"schemaVersion":1}`, "", "")
+	for _, body := range []string{"layer1", "layer2", "layer3"} {
+		cachetest.Put(t, src, cachetest.Blob(body), body, "application/octet-stream", "")
+	}
+	corrupt := cachetest.Put(t, src, cachetest.Blob("layer4"), "layer4", "", "")
+	assert.NoError(t, os.WriteFile(filepath.Join(src.CacheDirectory, corrupt), []byte("l4yer4"), 0644))
+	orphan := cachetest.Put(t, src, cachetest.Blob("layer5"), "layer5", "", "")
+	assert.NoError(t, os.Remove(filepath.Join(src.CacheDirectory, orphan+".json")))
+
+	m := &Migrator{Src: src, Dst: dst, Workers: 4, Verify: true, Logger: slog.New(slog.DiscardHandler)}
+	stats, err := m.Run(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Stats{Objects: 7, Copied: 5, Corrupt: 1, Orphans: 1, Bytes: int64(len(`{}` + `{"schemaVersion":1}` + "layer1layer2layer3"))}, *stats)
+
+	cached, _, err := dst.GetCache(ctx, &tag)
+	assert.NoError(t, err)
+	assert.Equal(t, "application/vnd.oci.image.index.v1+json", cached.GetMetadata().ContentType)
+	assert.Equal(t, cachetest.Digest(`{}`), cached.GetMetadata().DockerContentDigest)
+	body, err := cache.ReadObject(ctx, dst, &untagged, 1<<10)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"schemaVersion":1}`, string(body))
+	assert.NoFileExists(t, filepath.Join(dst.CacheDirectory, corrupt), "left to be fetched from upstream")
+	assert.NoFileExists(t, filepath.Join(dst.CacheDirectory, orphan))
+
+	// resume
+	m = &Migrator{Src: src, Dst: dst, Workers: 2, Logger: slog.New(slog.DiscardHandler)}
+	assert.NoError(t, os.Remove(filepath.Join(dst.CacheDirectory, cache.ObjectToCacheName(&untagged))))
+	stats, err = m.Run(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Copied)
+	assert.Equal(t, 4, stats.Skipped)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = m.Run(cancelled)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,52 @@
+package model
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// MaxManifestSize is the limit of manifest body to parse, as in distribution
+const MaxManifestSize = 4 << 20
+
+type descriptor struct {
+	Digest string `json:"digest"`
+}
+
+// manifest covers image index, OCI/docker image manifest and docker schema1
+type manifest struct {
+	Manifests []descriptor `json:"manifests"`
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	FSLayers  []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+}
+
+// ManifestReferences returns objects referenced by manifest body: platform manifests of an index in the same
+// repository, and config and layer blobs of an image manifest
+func ManifestReferences(object ObjectIdentifier, body []byte) ([]ObjectIdentifier, error) {
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	var res []ObjectIdentifier
+	add := func(digest string, t ObjectType) {
+		if !strings.HasPrefix(digest, "sha256:") {
+			return // like foreign layers with urls, or other algorithms not cached as blobs
+		}
+		res = append(res, ObjectIdentifier{Registry: object.Registry, Repository: object.Repository, Ref: digest, Type: t})
+	}
+	for _, d := range m.Manifests {
+		add(d.Digest, ObjectTypeManifest)
+	}
+	if m.Config != nil {
+		add(m.Config.Digest, ObjectTypeBlob)
+	}
+	for _, d := range m.Layers {
+		add(d.Digest, ObjectTypeBlob)
+	}
+	for _, l := range m.FSLayers {
+		add(l.BlobSum, ObjectTypeBlob)
+	}
+	return res, nil
+}
@@ -1,5 +1,7 @@
 package model
 
+import "strings"
+
 type ObjectType string
 
 const (
@@ -14,3 +16,41 @@ type ObjectIdentifier struct {
 	// ContentType string // Only really relevant for manifests depending on Accept header?
 	Type ObjectType
 }
+
+// registryAliases are names which previous versions normalized `ns` to
+var registryAliases = map[string]string{
+	"registry-1.docker.io": "docker.io",
+}
+
+// CanonicalRegistry returns registry name as in `ns` for the name or its alias, to keep settings of previous
+// versions keyed by `registry-1.docker.io` working
+func CanonicalRegistry(name string) string {
+	if canonical, ok := registryAliases[name]; ok {
+		return canonical
+	}
+	return name
+}
+
+// LegacyRegistry returns name previous versions normalized registry to, as used in cache keys
+func LegacyRegistry(name string) string {
+	for legacy, canonical := range registryAliases {
+		if canonical == name {
+			return legacy
+		}
+	}
+	return name
+}
+
+// MatchPrefix returns value of the longest key of m matching registry/repository, keys are registry or
+// registry/repo prefix
+func MatchPrefix[V any](m map[string]V, registry, repository string) (V, bool) {
+	fullPath := registry + "/" + repository
+	var res V
+	best := -1
+	for key, v := range m {
+		if len(key) > best && (key == registry || fullPath == key || strings.HasPrefix(fullPath, key+"/")) {
+			res, best = v, len(key)
+		}
+	}
+	return res, best != -1
+}
@@ -1,40 +1,48 @@
 package mux
 
 import (
+	"errors"
 	"log/slog"
 	"net/http"
 	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sepich/containerd-registry-cache/pkg/accesslog"
+	"github.com/sepich/containerd-registry-cache/pkg/auth"
 	"github.com/sepich/containerd-registry-cache/pkg/model"
 	"github.com/sepich/containerd-registry-cache/pkg/service"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Based off the result of remoteName from https://github.com/distribution/distribution's regexp.go
 const imageNamePattern = "[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*)*"
 
-var registryOverrides = map[string]string{
-	"docker.io": "registry-1.docker.io",
-}
+var tracer = otel.Tracer("github.com/sepich/containerd-registry-cache/pkg/mux")
 
-func NewRouter(s service.Service, logger *slog.Logger) *mux.Router {
+// NewRouter creates router for registry API, a could be nil to allow all clients
+func NewRouter(s service.Service, a auth.Authorizer, logger *slog.Logger) *mux.Router {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<h1>containerd-registry-cache</h1>
 		<a href="/metrics">/metrics</a> - prometheus metrics</br>
+		<a href="/healthz">/healthz</a> - liveness</br>
+		<a href="/readyz">/readyz</a> - readiness</br>
 		`))
 	})
 
 	r.HandleFunc("/v2/{repo:"+imageNamePattern+"}/manifests/{ref}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		handleService(s, vars, model.ObjectTypeManifest, r, w, logger)
+		handleService(s, a, vars, model.ObjectTypeManifest, r, w, logger)
 	})
 
 	r.HandleFunc("/v2/{repo:"+imageNamePattern+"}/blobs/{ref}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		handleService(s, vars, model.ObjectTypeBlob, r, w, logger)
+		handleService(s, a, vars, model.ObjectTypeBlob, r, w, logger)
 	})
 
 	r.Handle("/metrics", promhttp.Handler())
@@ -42,7 +50,7 @@ func NewRouter(s service.Service, logger *slog.Logger) *mux.Router {
 	return r
 }
 
-func handleService(s service.Service, vars map[string]string, t model.ObjectType, r *http.Request, w http.ResponseWriter, logger *slog.Logger) {
+func handleService(s service.Service, a auth.Authorizer, vars map[string]string, t model.ObjectType, r *http.Request, w http.ResponseWriter, logger *slog.Logger) {
 	repo := vars["repo"]
 	registry := r.URL.Query().Get("ns")
 	ip := r.RemoteAddr
@@ -57,20 +65,16 @@ func handleService(s service.Service, vars map[string]string, t model.ObjectType
 	if registry == "" {
 		w.WriteHeader(400)
 		w.Write([]byte("No `ns` query string found (are you using containerd?): I don't know what registry to ask for " + repo))
-		logger.Warn("Request had no `ns` query string, not sure what registry this is for", "host", r.Host, "headers", r.Header)
+		logger.Warn("Request had no `ns` query string, not sure what registry this is for", "host", r.Host, "headers", accesslog.Redact(r.Header))
 		return
 	}
 
-	if registryOverride, ok := registryOverrides[registry]; ok {
-		registry = registryOverride
-	}
-
 	isHead := false
 	if r.Method == "HEAD" {
 		isHead = true
 	} else if r.Method != "GET" {
 		w.WriteHeader(400)
-		logger.Warn("Method is not supported", "host", r.Host, "headers", r.Header)
+		logger.Warn("Method is not supported", "host", r.Host, "headers", accesslog.Redact(r.Header))
 		return
 	}
 
@@ -80,5 +84,32 @@ func handleService(s service.Service, vars map[string]string, t model.ObjectType
 		Ref:        vars["ref"],
 		Type:       t,
 	}
-	s.GetObject(object, isHead, &r.Header, w, logger)
+	if e := accesslog.FromContext(r.Context()); e != nil {
+		e.Registry, e.Repository, e.Ref, e.Type = registry, repo, object.Ref, string(t)
+	}
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "pull "+string(t), trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("oci.registry", registry),
+		attribute.String("oci.repository", repo),
+		attribute.String("oci.reference", object.Ref),
+		attribute.String("http.request.method", r.Method),
+	))
+	defer span.End()
+	if span.SpanContext().IsSampled() {
+		logger = logger.With("trace_id", span.SpanContext().TraceID().String())
+	}
+
+	if a != nil {
+		if err := a.Authorize(r, object); err != nil {
+			var authErr *auth.Error
+			if !errors.As(err, &authErr) {
+				authErr = &auth.Error{Status: http.StatusForbidden, Code: "DENIED", Message: err.Error()}
+			}
+			logger.Info("Client request denied", "reason", authErr.Message)
+			authErr.Write(w)
+			return
+		}
+	}
+	s.GetObject(ctx, object, isHead, &r.Header, w, logger)
 }
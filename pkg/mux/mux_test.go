@@ -1,12 +1,17 @@
 package mux
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
+	"github.com/sepich/containerd-registry-cache/pkg/auth"
 	"github.com/sepich/containerd-registry-cache/pkg/model"
 	"github.com/sepich/containerd-registry-cache/pkg/service"
 	"github.com/stretchr/testify/assert"
@@ -16,7 +21,16 @@ type noOpService struct{}
 
 var _ service.Service = &noOpService{}
 
-func (s *noOpService) GetObject(object *model.ObjectIdentifier, isHead bool, headers *http.Header, w http.ResponseWriter, logger *slog.Logger) {
+func (s *noOpService) GetObject(ctx context.Context, object *model.ObjectIdentifier, isHead bool, headers *http.Header, w http.ResponseWriter, logger *slog.Logger) {
+}
+
+// headersService records headers which would be passed to upstream
+type headersService struct {
+	headers http.Header
+}
+
+func (s *headersService) GetObject(ctx context.Context, object *model.ObjectIdentifier, isHead bool, headers *http.Header, w http.ResponseWriter, logger *slog.Logger) {
+	s.headers = headers.Clone()
 }
 
 func TestManifestsPaths(t *testing.T) {
@@ -54,7 +68,7 @@ func TestManifestsPaths(t *testing.T) {
 		},
 	}
 
-	r := NewRouter(&noOpService{}, slog.Default())
+	r := NewRouter(&noOpService{}, nil, slog.Default())
 
 	for _, tC := range testCases {
 		t.Run(strings.ReplaceAll(tC.url, "/", "-"), func(t *testing.T) {
@@ -105,7 +119,7 @@ func TestBlobPaths(t *testing.T) {
 		},
 	}
 
-	r := NewRouter(&noOpService{}, slog.Default())
+	r := NewRouter(&noOpService{}, nil, slog.Default())
 
 	for _, tC := range testCases {
 		t.Run(strings.ReplaceAll(tC.url, "/", "-"), func(t *testing.T) {
@@ -120,3 +134,67 @@ func TestBlobPaths(t *testing.T) {
 		})
 	}
 }
+
+func TestAuth(t *testing.T) {
+	rules, err := auth.New([]auth.Rule{{Tokens: []string{"secret"}}})
+	assert.NoError(t, err)
+	r := NewRouter(&noOpService{}, rules, slog.Default())
+
+	req := httptest.NewRequest("GET", "/v2/prom/node-exporter/manifests/v1.5.0?ns=docker.io", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, 401, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"UNAUTHORIZED"`)
+
+	req.Header.Set("Authorization", "Bearer secret")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, 200, rr.Code)
+}
+
+func TestAuthUpstreamHeaders(t *testing.T) {
+	rules, err := auth.New([]auth.Rule{
+		{Scope: []string{"quay.io"}, CIDRs: []string{"10.0.0.0/8"}},
+		{Scope: []string{"ghcr.io"}, ClientCerts: []string{"node1"}},
+		{Tokens: []string{"secret"}},
+	})
+	assert.NoError(t, err)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "node1"}}
+
+	testCases := []struct {
+		name   string
+		ns     string
+		header string
+		expect string // Authorization passed to upstream
+	}{
+		{name: "cidr", ns: "quay.io", header: "Bearer secret"},
+		{name: "cidr basic", ns: "quay.io", header: "Basic dXNlcjpzZWNyZXQ="},
+		{name: "cidr registry token", ns: "quay.io", header: "Bearer registry-token", expect: "Bearer registry-token"},
+		{name: "cert", ns: "ghcr.io", header: "Bearer secret"},
+		{name: "cert registry token", ns: "ghcr.io", header: "Bearer registry-token", expect: "Bearer registry-token"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.name, func(t *testing.T) {
+			s := &headersService{}
+			r := NewRouter(s, rules, slog.Default())
+			req := httptest.NewRequest("GET", "/v2/org/repo/manifests/latest?ns="+tC.ns, nil)
+			req.RemoteAddr = "10.1.2.3:1234"
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			req.Header.Set("Authorization", tC.header)
+			req.Header.Set(auth.TokenHeader, "secret")
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			assert.Equal(t, 200, rr.Code)
+			assert.Empty(t, s.headers.Get(auth.TokenHeader))
+			assert.Equal(t, tC.expect, s.headers.Get("Authorization"))
+		})
+	}
+
+	// no rules
+	s := &headersService{}
+	empty, _ := auth.New(nil)
+	req := httptest.NewRequest("GET", "/v2/org/repo/manifests/latest?ns=docker.io", nil)
+	req.Header.Set(auth.TokenHeader, "secret")
+	NewRouter(s, empty, slog.Default()).ServeHTTP(httptest.NewRecorder(), req)
+	assert.Empty(t, s.headers.Get(auth.TokenHeader))
+}
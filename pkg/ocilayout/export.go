@@ -0,0 +1,264 @@
+package ocilayout
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+)
+
+// Export writes cached images to w as OCI image-layout tar. Names are `registry/repository` for all its cached
+// manifests, or with `:tag` or `@digest` for a single image, as in `ns`. Empty names export the whole cache.
+// Layers never pulled through the cache are not in the archive, they are counted as missing.
+func Export(ctx context.Context, store cache.Store, w io.Writer, names []string, logger *slog.Logger) (*Stats, error) {
+	roots, err := selectRoots(ctx, store, names)
+	if err != nil {
+		return nil, err
+	}
+	e := &exporter{
+		c:          store,
+		logger:     logger,
+		descs:      map[string]*descriptor{},
+		manifests:  map[string][]byte{},
+		referenced: map[string]bool{},
+		visited:    map[string]bool{},
+	}
+	descs := make([]*descriptor, len(roots))
+	for i, object := range roots {
+		if descs[i], err = e.manifest(ctx, object); err != nil {
+			return nil, err
+		}
+		if descs[i] == nil && len(names) != 0 {
+			return nil, fmt.Errorf("image `%s` is not cached", ImageName(object))
+		}
+	}
+	var images []descriptor
+	for i, object := range roots {
+		// platform manifests are exported with their index, unless selected explicitly
+		if descs[i] == nil || len(names) == 0 && strings.HasPrefix(object.Ref, "sha256:") && e.referenced[cache.ObjectToCacheName(&object)] {
+			continue
+		}
+		image := *descs[i]
+		image.Annotations = map[string]string{annotationName: ImageName(object)}
+		if !strings.HasPrefix(object.Ref, "sha256:") {
+			image.Annotations[annotationRef] = object.Ref
+		}
+		images = append(images, image)
+	}
+	e.stats.Images = len(images)
+	return &e.stats, e.write(ctx, w, images)
+}
+
+// selectRoots returns manifests to export, tags first
+func selectRoots(ctx context.Context, store cache.Store, names []string) ([]model.ObjectIdentifier, error) {
+	var roots []model.ObjectIdentifier
+	repos := map[string]bool{}
+	for _, name := range names {
+		object, err := ParseImageName(name)
+		if err != nil {
+			return nil, err
+		}
+		if object.Ref != "" {
+			roots = append(roots, object)
+		} else {
+			repos[object.Registry+"/"+object.Repository] = true
+		}
+	}
+	if len(names) == 0 || len(repos) != 0 {
+		var found []model.ObjectIdentifier
+		err := store.Walk(ctx, func(o cache.ObjectInfo) error {
+			if o.Orphan || o.Type != model.ObjectTypeManifest {
+				return nil
+			}
+			if len(names) == 0 || repos[o.Registry+"/"+o.Repository] {
+				found = append(found, o.ObjectIdentifier)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 && len(repos) != 0 {
+			return nil, fmt.Errorf("no cached manifests found for %v", names)
+		}
+		roots = append(roots, found...)
+	}
+	slices.SortStableFunc(roots, func(a, b model.ObjectIdentifier) int {
+		aDigest, bDigest := strings.HasPrefix(a.Ref, "sha256:"), strings.HasPrefix(b.Ref, "sha256:")
+		switch {
+		case aDigest == bDigest:
+			return 0
+		case bDigest:
+			return -1
+		}
+		return 1
+	})
+	return roots, nil
+}
+
+type blob struct {
+	object model.ObjectIdentifier
+	size   int64
+}
+
+type exporter struct {
+	c      cache.CachingService
+	logger *slog.Logger
+	stats  Stats
+
+	descs      map[string]*descriptor // of manifests by cache key
+	manifests  map[string][]byte      // bodies by digest
+	order      []string               // of manifest digests
+	blobs      []blob
+	referenced map[string]bool // cache keys of child manifests
+	visited    map[string]bool // cache keys of blobs
+}
+
+// manifest collects the manifest with everything it references, nil if it is not cached
+func (e *exporter) manifest(ctx context.Context, object model.ObjectIdentifier) (*descriptor, error) {
+	key := cache.ObjectToCacheName(&object)
+	if desc, ok := e.descs[key]; ok {
+		return desc, nil
+	}
+	cached, _, err := e.c.GetCache(ctx, &object)
+	if err != nil || cached == nil {
+		return nil, err
+	}
+	meta := cached.GetMetadata()
+	meta.ObjectIdentifier = object
+	body, err := cache.ReadObject(ctx, e.c, &object, model.MaxManifestSize)
+	if err != nil || body == nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if expected := cache.ExpectedDigest(meta); expected != "" && expected != digest {
+		e.logger.Warn("Skipping corrupt cached manifest", "image", ImageName(object), "expected", expected, "actual", digest)
+		return nil, nil
+	}
+	desc := &descriptor{MediaType: meta.ContentType, Digest: digest, Size: int64(len(body))}
+	if desc.MediaType == "" {
+		desc.MediaType = mediaType(body)
+	}
+	e.descs[key] = desc
+	if _, ok := e.manifests[digest]; !ok {
+		e.manifests[digest] = body
+		e.order = append(e.order, digest)
+	}
+
+	refs, err := model.ManifestReferences(object, body)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse manifest %s: %w", ImageName(object), err)
+	}
+	for _, ref := range refs {
+		if ref.Type == model.ObjectTypeManifest {
+			e.referenced[cache.ObjectToCacheName(&ref)] = true
+			if child, err := e.manifest(ctx, ref); err != nil {
+				return nil, err
+			} else if child == nil {
+				e.missing(ref)
+			}
+			continue
+		}
+		if err := e.blob(ctx, ref); err != nil {
+			return nil, err
+		}
+	}
+	return desc, nil
+}
+
+func (e *exporter) blob(ctx context.Context, object model.ObjectIdentifier) error {
+	key := cache.ObjectToCacheName(&object)
+	if e.visited[key] {
+		return nil
+	}
+	e.visited[key] = true
+	cached, _, err := e.c.GetCache(ctx, &object)
+	if err != nil {
+		return err
+	}
+	if cached == nil {
+		e.missing(object)
+		return nil
+	}
+	e.blobs = append(e.blobs, blob{object: object, size: cached.GetMetadata().SizeBytes})
+	return nil
+}
+
+func (e *exporter) missing(object model.ObjectIdentifier) {
+	e.stats.Missing++
+	e.logger.Debug("Referenced object is not cached", "registry", object.Registry, "repository", object.Repository, "ref", object.Ref, "type", object.Type)
+}
+
+// write puts index first, then manifests, so that the archive could be processed in a single pass
+func (e *exporter) write(ctx context.Context, w io.Writer, images []descriptor) error {
+	tw := tar.NewWriter(w)
+	data, _ := json.Marshal(layout{Version: "1.0.0"})
+	if err := writeFile(tw, layoutFile, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return err
+	}
+	data, _ = json.Marshal(index{SchemaVersion: 2, MediaType: mediaTypeIndex, Manifests: images})
+	if err := writeFile(tw, indexFile, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return err
+	}
+	for _, digest := range e.order {
+		body := e.manifests[digest]
+		if err := writeFile(tw, blobsDir+strings.TrimPrefix(digest, "sha256:"), int64(len(body)), bytes.NewReader(body)); err != nil {
+			return err
+		}
+		e.stats.Manifests++
+		e.stats.Bytes += int64(len(body))
+	}
+	for _, b := range e.blobs {
+		if err := e.writeBlob(ctx, tw, b); err != nil {
+			return err
+		}
+		e.stats.Blobs++
+		e.stats.Bytes += b.size
+	}
+	return tw.Close()
+}
+
+// writeBlob streams blob from cache, failing on digest mismatch as the archive is already written partially
+func (e *exporter) writeBlob(ctx context.Context, tw *tar.Writer, b blob) error {
+	cached, _, err := e.c.GetCache(ctx, &b.object)
+	if err != nil {
+		return err
+	}
+	if cached == nil {
+		return fmt.Errorf("blob %s was removed from cache during export", b.object.Ref)
+	}
+	r, err := cached.GetReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if err := writeFile(tw, blobsDir+strings.TrimPrefix(b.object.Ref, "sha256:"), b.size, io.TeeReader(r, h)); err != nil {
+		return fmt.Errorf("could not export blob %s: %w", b.object.Ref, err)
+	}
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != b.object.Ref {
+		return fmt.Errorf("cached blob is corrupt, expected %s, actual %s", b.object.Ref, actual)
+	}
+	return nil
+}
+
+func writeFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{Name: name, Size: size, Mode: 0644, ModTime: time.Now(), Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
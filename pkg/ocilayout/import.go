@@ -0,0 +1,264 @@
+package ocilayout
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+)
+
+// blobContentType is saved for imported blobs, as registries respond with it
+const blobContentType = "application/octet-stream"
+
+var errCorrupt = errors.New("archive is corrupt")
+var errNotFound = errors.New("not found in archive")
+
+// Import stores images from OCI image-layout tar of size in c, verifying digests of all the content. Images are
+// named by `io.containerd.image.name` annotation, or by `org.opencontainers.image.ref.name` tag in repository
+// (as `registry/repository`) for archives by other tools. Objects already cached are skipped, tags are updated.
+// Archive is read at random, as index.json is not necessarily at the start.
+func Import(ctx context.Context, c cache.CachingService, r io.ReaderAt, size int64, repository string, logger *slog.Logger) (*Stats, error) {
+	files, err := scan(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	im := &importer{c: c, r: r, files: files, logger: logger, visited: map[string]bool{}}
+
+	data, err := im.file(layoutFile, 1<<10)
+	if err != nil {
+		return nil, err
+	}
+	var l layout
+	if err := json.Unmarshal(data, &l); err != nil || l.Version != "1.0.0" {
+		return nil, fmt.Errorf("unsupported %s: %s", layoutFile, data)
+	}
+	if data, err = im.file(indexFile, model.MaxManifestSize); err != nil {
+		return nil, err
+	}
+	var idx index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", indexFile, err)
+	}
+
+	for _, desc := range idx.Manifests {
+		object, err := imageObject(desc, repository)
+		if err != nil {
+			logger.Warn("Skipping image without name", "digest", desc.Digest, "error", err)
+			continue
+		}
+		if err := im.manifest(ctx, object, desc.Digest, desc.MediaType); err != nil {
+			return &im.stats, fmt.Errorf("could not import %s: %w", ImageName(object), err)
+		}
+		im.stats.Images++
+	}
+	return &im.stats, nil
+}
+
+// imageObject returns manifest to store image of index.json as
+func imageObject(desc descriptor, repository string) (model.ObjectIdentifier, error) {
+	name := desc.Annotations[annotationName]
+	if ref := desc.Annotations[annotationRef]; name == "" && strings.Contains(ref, "/") {
+		name = ref // full name, as by `docker save`
+	} else if name == "" && repository != "" {
+		name = repository + "@" + desc.Digest
+		if ref != "" {
+			name = repository + ":" + ref
+		}
+	}
+	if name == "" {
+		return model.ObjectIdentifier{}, fmt.Errorf("no %s annotation, set repository to import to", annotationName)
+	}
+	object, err := ParseImageName(name)
+	if err == nil && object.Ref == "" {
+		object.Ref = desc.Digest
+	}
+	return object, err
+}
+
+type section struct {
+	offset, size int64
+}
+
+// scan returns offsets of regular files in the archive, by normalized name
+func scan(r io.Reader) (map[string]section, error) {
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	files := map[string]section{}
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read archive: %w", err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			// data follows the header, and is skipped by reading on the next call
+			files[strings.TrimPrefix(path.Clean(h.Name), "/")] = section{offset: cr.n, size: h.Size}
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type importer struct {
+	c      cache.CachingService
+	r      io.ReaderAt
+	files  map[string]section
+	logger *slog.Logger
+	stats  Stats
+
+	visited map[string]bool // cache keys
+}
+
+func (im *importer) open(name string) (*io.SectionReader, error) {
+	s, ok := im.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, errNotFound)
+	}
+	return io.NewSectionReader(im.r, s.offset, s.size), nil
+}
+
+func (im *importer) file(name string, limit int64) ([]byte, error) {
+	r, err := im.open(name)
+	if err != nil {
+		return nil, err
+	}
+	if r.Size() > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes", name, limit)
+	}
+	return io.ReadAll(r)
+}
+
+func blobPath(digest string) (string, error) {
+	hex, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(hex) != 64 || strings.ContainsAny(hex, "/.") {
+		return "", fmt.Errorf("unsupported digest `%s`", digest)
+	}
+	return blobsDir + hex, nil
+}
+
+// manifest stores manifest by tag and digest, with everything it references
+func (im *importer) manifest(ctx context.Context, object model.ObjectIdentifier, digest, contentType string) error {
+	name, err := blobPath(digest)
+	if err != nil {
+		return err
+	}
+	body, err := im.file(name, model.MaxManifestSize)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	if actual := "sha256:" + hex.EncodeToString(sum[:]); actual != digest {
+		return fmt.Errorf("%w, manifest %s has digest %s", errCorrupt, digest, actual)
+	}
+	if contentType == "" {
+		contentType = mediaType(body)
+	}
+	objects := []model.ObjectIdentifier{object}
+	if object.Ref != digest {
+		byDigest := object
+		byDigest.Ref = digest
+		objects = append(objects, byDigest)
+	}
+	for _, o := range objects {
+		key := cache.ObjectToCacheName(&o)
+		if im.visited[key] {
+			continue
+		}
+		im.visited[key] = true
+		if err := im.store(ctx, o, digest, contentType, bytes.NewReader(body)); err != nil {
+			return err
+		}
+	}
+
+	refs, err := model.ManifestReferences(object, body)
+	if err != nil {
+		return fmt.Errorf("could not parse manifest %s: %w", digest, err)
+	}
+	for _, ref := range refs {
+		if ref.Type == model.ObjectTypeManifest {
+			if im.visited[cache.ObjectToCacheName(&ref)] {
+				continue
+			}
+			err = im.manifest(ctx, ref, ref.Ref, "")
+		} else {
+			err = im.blob(ctx, ref)
+		}
+		if errors.Is(err, errNotFound) {
+			// like layers never pulled through the cache exported
+			im.stats.Missing++
+			im.logger.Debug("Referenced object is not in archive", "ref", ref.Ref, "type", ref.Type)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) blob(ctx context.Context, object model.ObjectIdentifier) error {
+	key := cache.ObjectToCacheName(&object)
+	if im.visited[key] {
+		return nil
+	}
+	im.visited[key] = true
+	name, err := blobPath(object.Ref)
+	if err != nil {
+		return err
+	}
+	r, err := im.open(name)
+	if err != nil {
+		return err
+	}
+	return im.store(ctx, object, object.Ref, blobContentType, r)
+}
+
+// store writes object unless it is already cached with the same digest, failing on digest mismatch
+func (im *importer) store(ctx context.Context, object model.ObjectIdentifier, digest, contentType string, r io.Reader) error {
+	cached, w, err := im.c.GetCache(ctx, &object)
+	if err != nil {
+		return err
+	}
+	if cached != nil && (object.Ref == digest || cached.GetMetadata().DockerContentDigest == digest) {
+		im.stats.Skipped++
+		return nil
+	}
+	defer w.Cleanup()
+	h := sha256.New()
+	n, err := io.Copy(w, io.TeeReader(r, h))
+	if err != nil {
+		return err
+	}
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return fmt.Errorf("%w, %s has digest %s", errCorrupt, digest, actual)
+	}
+	if err := w.Close(ctx, contentType, digest); err != nil {
+		return err
+	}
+	if object.Type == model.ObjectTypeManifest {
+		im.stats.Manifests++
+	} else {
+		im.stats.Blobs++
+	}
+	im.stats.Bytes += n
+	return nil
+}
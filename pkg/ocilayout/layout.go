@@ -0,0 +1,92 @@
+// Package ocilayout exports cached images to OCI image-layout tar archives and imports them back, for air-gapped
+// clusters and seeding caches in new regions.
+package ocilayout
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+)
+
+const (
+	layoutFile = "oci-layout"
+	indexFile  = "index.json"
+	blobsDir   = "blobs/sha256/"
+
+	mediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	mediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	// annotationName keeps the full name with registry as in `ns`, so that lookups hit after import. The same
+	// annotation is used by `ctr image export`.
+	annotationName = "io.containerd.image.name"
+	// annotationRef is the tag, as the full name is not expected here by other tools
+	annotationRef = "org.opencontainers.image.ref.name"
+)
+
+type layout struct {
+	Version string `json:"imageLayoutVersion"`
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+type Stats struct {
+	Images    int   `json:"images"`
+	Manifests int   `json:"manifests"`
+	Blobs     int   `json:"blobs"`
+	Bytes     int64 `json:"bytes"`
+	Skipped   int   `json:"skipped"` // already existing on import
+	Missing   int   `json:"missing"` // referenced but not cached on export, or not in archive on import
+}
+
+// ImageName returns the full name of manifest like `docker.io/library/alpine:3.20`, or `@sha256:...` for digests
+func ImageName(object model.ObjectIdentifier) string {
+	name := object.Registry + "/" + object.Repository
+	if strings.HasPrefix(object.Ref, "sha256:") {
+		return name + "@" + object.Ref
+	}
+	return name + ":" + object.Ref
+}
+
+// ParseImageName parses ImageName result back to manifest object. Without tag or digest, Ref is empty.
+func ParseImageName(name string) (model.ObjectIdentifier, error) {
+	object := model.ObjectIdentifier{Type: model.ObjectTypeManifest}
+	if n, digest, ok := strings.Cut(name, "@"); ok {
+		name, object.Ref = n, digest
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, object.Ref = name[:i], name[i+1:]
+	}
+	registry, repository, ok := strings.Cut(name, "/")
+	if !ok || registry == "" || repository == "" {
+		return object, fmt.Errorf("image name should be `registry/repository[:tag|@digest]`, got `%s`", name)
+	}
+	object.Registry, object.Repository = registry, repository
+	return object, nil
+}
+
+// mediaType returns media type of manifest body, when it was not saved from upstream response
+func mediaType(body []byte) string {
+	var m struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if json.Unmarshal(body, &m) == nil && m.MediaType != "" {
+		return m.MediaType
+	}
+	if m.Manifests != nil {
+		return mediaTypeIndex
+	}
+	return mediaTypeManifest
+}
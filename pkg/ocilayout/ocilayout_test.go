@@ -0,0 +1,98 @@
+package ocilayout
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/cache/cachetest"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func read(t *testing.T, c cache.CachingService, object model.ObjectIdentifier) string {
+	body, err := cache.ReadObject(context.Background(), c, &object, 1<<20)
+	assert.NoError(t, err)
+	return string(body)
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.DiscardHandler)
+	src := &cache.FileCache{CacheDirectory: t.TempDir()}
+
+	config, layer := `{"architecture":"amd64"}`, "layer"
+	platform := `{"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":"` + cachetest.Digest(config) + `"},"layers":[{"digest":"` + cachetest.Digest(layer) + `"},{"digest":"` + cachetest.Digest("not pulled") + `"}]}`
+	idx := `{"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"digest":"` + cachetest.Digest(platform) + `"}]}`
+	tag := model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: "3.20", Type: model.ObjectTypeManifest}
+	cachetest.Put(t, src, tag, idx, mediaTypeIndex, cachetest.Digest(idx))
+	cachetest.Put(t, src, model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: cachetest.Digest(platform), Type: model.ObjectTypeManifest}, platform, "", cachetest.Digest(platform))
+	cachetest.Put(t, src, cachetest.Blob(config), config, "", cachetest.Digest(config))
+	cachetest.Put(t, src, cachetest.Blob(layer), layer, "", cachetest.Digest(layer))
+	other := model.ObjectIdentifier{Registry: "ghcr.io", Repository: "org/app", Ref: "v1", Type: model.ObjectTypeManifest}
+	cachetest.Put(t, src, other, `{}`, "", cachetest.Digest(`{}`))
+
+	var archive bytes.Buffer
+	stats, err := Export(ctx, src, &archive, nil, logger)
+	assert.NoError(t, err)
+	assert.Equal(t, Stats{Images: 2, Manifests: 3, Blobs: 2, Bytes: int64(len(idx + platform + `{}` + config + layer)), Missing: 1}, *stats)
+
+	dst := &cache.FileCache{CacheDirectory: t.TempDir()}
+	stats, err = Import(ctx, dst, bytes.NewReader(archive.Bytes()), int64(archive.Len()), "", logger)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Images)
+	assert.Equal(t, 2, stats.Blobs)
+	assert.Equal(t, 1, stats.Missing)
+	assert.Equal(t, idx, read(t, dst, tag))
+	assert.Equal(t, idx, read(t, dst, model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: cachetest.Digest(idx), Type: model.ObjectTypeManifest}), "tag is resolved to digest by containerd")
+	assert.Equal(t, platform, read(t, dst, model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: cachetest.Digest(platform), Type: model.ObjectTypeManifest}))
+	assert.Equal(t, layer, read(t, dst, model.ObjectIdentifier{Ref: cachetest.Digest(layer), Type: model.ObjectTypeBlob}))
+	assert.Equal(t, `{}`, read(t, dst, other))
+	cached, _, err := dst.GetCache(ctx, &tag)
+	assert.NoError(t, err)
+	assert.Equal(t, mediaTypeIndex, cached.GetMetadata().ContentType)
+	assert.Equal(t, cachetest.Digest(idx), cached.GetMetadata().DockerContentDigest)
+
+	stats, err = Import(ctx, dst, bytes.NewReader(archive.Bytes()), int64(archive.Len()), "", logger)
+	assert.NoError(t, err)
+	assert.Zero(t, stats.Manifests+stats.Blobs, "existing objects are skipped")
+	assert.Equal(t, 7, stats.Skipped, "tags are stored by digest too")
+
+	// selected image only
+	archive.Reset()
+	stats, err = Export(ctx, src, &archive, []string{"ghcr.io/org/app"}, logger)
+	assert.NoError(t, err)
+	assert.Equal(t, Stats{Images: 1, Manifests: 1, Bytes: 2}, *stats)
+	_, err = Export(ctx, src, io.Discard, []string{"ghcr.io/org/app:v2"}, logger)
+	assert.Error(t, err)
+}
+
+func TestImportCorrupt(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.DiscardHandler)
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	files := map[string]string{
+		"oci-layout": `{"imageLayoutVersion":"1.0.0"}`,
+		"index.json": `{"manifests":[{"digest":"` + cachetest.Digest(`{}`) + `","annotations":{"org.opencontainers.image.ref.name":"v1"}}]}`,
+		"blobs/sha256/" + cachetest.Digest(`{}`)[7:]: `{"layers":[{"digest":"` + cachetest.Digest("layer") + `"}]}`,
+	}
+	for _, name := range []string{"blobs/sha256/" + cachetest.Digest(`{}`)[7:], "index.json", "oci-layout"} {
+		assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "./" + name, Size: int64(len(files[name])), Mode: 0644}))
+		tw.Write([]byte(files[name]))
+	}
+	assert.NoError(t, tw.Close())
+
+	dst := &cache.FileCache{CacheDirectory: t.TempDir()}
+	stats, err := Import(ctx, dst, bytes.NewReader(archive.Bytes()), int64(archive.Len()), "", logger)
+	assert.NoError(t, err)
+	assert.Zero(t, stats.Images, "no name without repository")
+
+	_, err = Import(ctx, dst, bytes.NewReader(archive.Bytes()), int64(archive.Len()), "ghcr.io/org/app", logger)
+	assert.ErrorIs(t, err, errCorrupt)
+	assert.Empty(t, read(t, dst, model.ObjectIdentifier{Registry: "ghcr.io", Repository: "org/app", Ref: "v1", Type: model.ObjectTypeManifest}))
+}
@@ -0,0 +1,331 @@
+package scrub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/usage"
+	"golang.org/x/time/rate"
+)
+
+var checkedObjects = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "containerd_cache_scrub_objects_total",
+	Help: "Objects checked by scrubber by result: ok, corrupt, orphan, unverified, error",
+}, []string{"result"})
+
+var checkedBytes = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "containerd_cache_scrub_bytes_total",
+	Help: "Bytes read by scrubber",
+})
+
+var passObjects = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "containerd_cache_scrub_pass_objects",
+	Help: "Objects checked in the current scrub pass, 0 when idle",
+})
+
+var lastPassObjects = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "containerd_cache_scrub_last_pass_objects",
+	Help: "Objects checked in the last finished scrub pass, to estimate progress of the current one",
+})
+
+var lastPass = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "containerd_cache_scrub_last_pass_timestamp_seconds",
+	Help: "Timestamp of the last finished scrub pass by this replica",
+})
+
+// reportName is the report of the last pass by any replica sharing the cache, to run only once per interval
+const reportName = "scrub/report.json"
+
+// orphanAge skips half-written entries, as data is renamed before its sidecar is written
+const orphanAge = time.Hour
+
+// maxReportKeys limits removed keys listed in the report
+const maxReportKeys = 1000
+
+// checkInterval to check whether the next pass is due
+const checkInterval = time.Minute
+
+var ErrRunning = errors.New("scrub is already running")
+
+// Policy could be changed at runtime, applied on the next pass
+type Policy struct {
+	Interval time.Duration // between passes, 0 to disable scheduled passes
+	Rate     int64         // bytes per second to read, 0 for unlimited
+	Delete   bool          // delete corrupt and orphaned objects instead of quarantine
+}
+
+type Report struct {
+	Replica    string    `json:"replica"`
+	Started    time.Time `json:"started"`
+	Duration   string    `json:"duration,omitempty"` // empty while running
+	Objects    int       `json:"objects"`
+	Bytes      int64     `json:"bytes"`
+	Corrupt    int       `json:"corrupt"`
+	Orphans    int       `json:"orphans"`
+	Unverified int       `json:"unverified"` // tags without digest
+	Errors     int       `json:"errors"`
+	Removed    []string  `json:"removed,omitempty"` // keys of quarantined or deleted objects
+}
+
+// Scrubber re-verifies cached objects in background: content against digest, and data against metadata pairs.
+// Corrupt and orphaned objects are moved to quarantine or deleted, to be fetched from upstream on the next pull.
+type Scrubber struct {
+	Store   cache.Store
+	Usage   *usage.Index // removed objects are dropped from it, optional
+	Replica string
+	Logger  *slog.Logger
+
+	policy  atomic.Pointer[Policy]
+	running sync.Mutex
+	mu      sync.Mutex
+	current *Report // of the pass in progress
+}
+
+func (s *Scrubber) SetPolicy(p Policy) {
+	s.policy.Store(&p)
+}
+
+// Run starts scheduled passes until ctx is done. Only one replica sharing the cache runs it per interval.
+func (s *Scrubber) Run(ctx context.Context) {
+	t := time.NewTicker(checkInterval)
+	defer t.Stop()
+	for {
+		if p := s.policy.Load(); p != nil && p.Interval > 0 {
+			if last, err := s.lastRun(ctx); err != nil {
+				s.Logger.Warn("Could not check last scrub", "error", err)
+			} else if time.Since(last) >= p.Interval {
+				if _, err := s.Scrub(ctx); err != nil && !errors.Is(err, ErrRunning) {
+					s.Logger.Error("Scrub failed", "error", err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *Scrubber) lastRun(ctx context.Context) (time.Time, error) {
+	files, err := s.Store.ListMeta(ctx, reportName)
+	if err != nil || len(files) == 0 {
+		return time.Time{}, err
+	}
+	return files[0].ModTime, nil
+}
+
+// Status returns report of the pass in progress, or the last one by any replica
+func (s *Scrubber) Status(ctx context.Context) (*Report, error) {
+	s.mu.Lock()
+	if s.current != nil {
+		r := *s.current
+		s.mu.Unlock()
+		return &r, nil
+	}
+	s.mu.Unlock()
+	data, err := s.Store.ReadMeta(ctx, reportName)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{}
+	return r, json.Unmarshal(data, r)
+}
+
+// Scrub runs a pass over all the cached objects
+func (s *Scrubber) Scrub(ctx context.Context) (*Report, error) {
+	if !s.running.TryLock() {
+		return nil, ErrRunning
+	}
+	defer s.running.Unlock()
+	return s.pass(ctx)
+}
+
+// Start runs a pass in background, as it could take hours
+func (s *Scrubber) Start(ctx context.Context) error {
+	if !s.running.TryLock() {
+		return ErrRunning
+	}
+	go func() {
+		defer s.running.Unlock()
+		if _, err := s.pass(ctx); err != nil {
+			s.Logger.Error("Scrub failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Scrubber) pass(ctx context.Context) (*Report, error) {
+	p := s.policy.Load()
+	if p == nil {
+		p = &Policy{}
+	}
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if p.Rate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(p.Rate), int(min(p.Rate, 1<<20)))
+	}
+	r := &Report{Replica: s.Replica, Started: time.Now()}
+	s.mu.Lock()
+	s.current = r
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.current = nil
+		s.mu.Unlock()
+		passObjects.Set(0)
+	}()
+	// mark the pass as started for other replicas
+	s.save(ctx, r)
+	s.Logger.Info("Scrub started", "rate", p.Rate, "delete", p.Delete)
+
+	err := s.Store.Walk(ctx, func(o cache.ObjectInfo) error {
+		result, n, err := s.check(ctx, o, limiter)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			s.Logger.Warn("Could not check object", "key", o.Key, "error", err)
+		}
+		if result == "" {
+			return nil
+		}
+		checkedObjects.WithLabelValues(result).Inc()
+		checkedBytes.Add(float64(n))
+		passObjects.Inc()
+
+		remove := result == "corrupt" || result == "orphan"
+		if remove {
+			s.Logger.Warn("Removing object from cache", "key", o.Key, "result", result, "delete", p.Delete, "error", err)
+			if p.Delete {
+				err = s.Store.Delete(ctx, o.Key)
+			} else {
+				err = s.Store.Quarantine(ctx, o.Key)
+			}
+			if err != nil {
+				s.Logger.Error("Could not remove object", "key", o.Key, "error", err)
+			} else if s.Usage != nil {
+				s.Usage.Remove(o.Key)
+			}
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		r.Objects++
+		r.Bytes += n
+		switch result {
+		case "corrupt":
+			r.Corrupt++
+		case "orphan":
+			r.Orphans++
+		case "unverified":
+			r.Unverified++
+		case "error":
+			r.Errors++
+		}
+		if remove && err != nil {
+			r.Errors++
+		} else if remove && len(r.Removed) < maxReportKeys {
+			r.Removed = append(r.Removed, o.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	r.Duration = time.Since(r.Started).Round(time.Second).String()
+	res := *r
+	s.mu.Unlock()
+	lastPass.SetToCurrentTime()
+	lastPassObjects.Set(float64(res.Objects))
+	s.save(ctx, &res)
+	s.Logger.Info("Scrub finished", "duration", res.Duration, "objects", res.Objects, "bytes", res.Bytes,
+		"corrupt", res.Corrupt, "orphans", res.Orphans, "errors", res.Errors)
+	return &res, nil
+}
+
+func (s *Scrubber) save(ctx context.Context, r *Report) {
+	s.mu.Lock()
+	data, err := json.Marshal(r)
+	s.mu.Unlock()
+	if err == nil {
+		err = s.Store.WriteMeta(ctx, reportName, data)
+	}
+	if err != nil {
+		s.Logger.Warn("Could not save scrub report", "error", err)
+	}
+}
+
+// check returns result of the object and bytes read, empty result to skip it
+func (s *Scrubber) check(ctx context.Context, o cache.ObjectInfo, limiter *rate.Limiter) (string, int64, error) {
+	if o.Orphan {
+		if time.Since(o.ModTime) < orphanAge {
+			return "", 0, nil
+		}
+		return "orphan", 0, nil
+	}
+	cached, _, err := s.Store.GetCache(ctx, &o.ObjectIdentifier)
+	if err != nil {
+		return "error", 0, err
+	}
+	if cached == nil {
+		return "", 0, nil // removed meanwhile
+	}
+	meta := cached.GetMetadata()
+	meta.ObjectIdentifier = o.ObjectIdentifier // digest-named path
+	expected := cache.ExpectedDigest(meta)
+	if expected == "" {
+		return "unverified", 0, nil
+	}
+
+	body, err := cached.GetReader(ctx)
+	if err != nil {
+		return "error", 0, err
+	}
+	defer body.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, &rateReader{ctx: ctx, r: body, limiter: limiter})
+	if err != nil {
+		return "error", n, err
+	}
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return "corrupt", n, fmt.Errorf("digest mismatch, expected %s, actual %s", expected, actual)
+	}
+	if n != meta.SizeBytes {
+		return "corrupt", n, fmt.Errorf("size mismatch, expected %d, actual %d", meta.SizeBytes, n)
+	}
+	return "ok", n, nil
+}
+
+// rateReader limits read rate to not affect serving clients
+type rateReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	if b := r.limiter.Burst(); b > 0 && len(p) > b {
+		p = p[:b]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 && r.limiter.Limit() != rate.Inf {
+		if werr := r.limiter.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
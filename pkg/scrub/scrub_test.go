@@ -0,0 +1,78 @@
+package scrub
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/cache/cachetest"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+	"github.com/sepich/containerd-registry-cache/pkg/usage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrub(t *testing.T) {
+	ctx := context.Background()
+	c := &cache.FileCache{CacheDirectory: t.TempDir()}
+	path := func(key string) string { return filepath.Join(c.CacheDirectory, key) }
+
+	cachetest.Put(t, c, cachetest.Blob("good"), "good", "", "")
+	cachetest.Put(t, c, model.ObjectIdentifier{Registry: "docker.io", Repository: "app", Ref: "v1", Type: model.ObjectTypeManifest}, "{}", "", "")
+	corrupt := cachetest.Put(t, c, cachetest.Blob("corrupt"), "corrupt", "", "")
+	assert.NoError(t, os.WriteFile(path(corrupt), []byte("c0rrupt"), 0644))
+	orphan := cachetest.Put(t, c, cachetest.Blob("orphan"), "orphan", "", "")
+	assert.NoError(t, os.Remove(path(orphan)+".json"))
+	old := time.Now().Add(-2 * orphanAge)
+	assert.NoError(t, os.Chtimes(path(orphan), old, old))
+	young := cachetest.Put(t, c, cachetest.Blob("young"), "young", "", "")
+	assert.NoError(t, os.Remove(path(young)+".json"))
+
+	idx := usage.New(c, "a", slog.New(slog.DiscardHandler))
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go idx.Run(runCtx, time.Hour)
+	assert.Eventually(t, func() bool {
+		entries, err := idx.Entries(ctx)
+		return err == nil && entries[corrupt] != nil
+	}, time.Second, 10*time.Millisecond, "filled from the cache")
+
+	s := &Scrubber{Store: c, Usage: idx, Logger: slog.New(slog.DiscardHandler)}
+	_, err := s.Status(ctx)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	s.SetPolicy(Policy{Rate: 1 << 20})
+
+	report, err := s.Scrub(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, report.Objects)
+	assert.Equal(t, 1, report.Corrupt)
+	assert.Equal(t, 1, report.Orphans)
+	assert.Equal(t, 1, report.Unverified)
+	assert.Zero(t, report.Errors)
+	assert.ElementsMatch(t, []string{corrupt, orphan}, report.Removed)
+	assert.NoFileExists(t, path(corrupt))
+	assert.FileExists(t, filepath.Join(c.CacheDirectory, "_meta", "quarantine", corrupt))
+	assert.FileExists(t, filepath.Join(c.CacheDirectory, "_meta", "quarantine", corrupt+".json"))
+	assert.FileExists(t, filepath.Join(c.CacheDirectory, "_meta", "quarantine", orphan))
+	assert.FileExists(t, path(young), "could be half-written")
+	entries, err := idx.Entries(ctx)
+	assert.NoError(t, err)
+	assert.NotContains(t, entries, corrupt)
+
+	last, err := s.Status(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, report.Removed, last.Removed)
+
+	// delete instead of quarantine
+	corrupt = cachetest.Put(t, c, cachetest.Blob("another"), "another", "", "")
+	assert.NoError(t, os.WriteFile(path(corrupt), []byte("4nother"), 0644))
+	s.SetPolicy(Policy{Delete: true})
+	report, err = s.Scrub(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{corrupt}, report.Removed)
+	assert.NoFileExists(t, path(corrupt))
+	assert.NoFileExists(t, filepath.Join(c.CacheDirectory, "_meta", "quarantine", corrupt))
+}
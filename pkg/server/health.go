@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// checkTimeout limits each readiness check
+const checkTimeout = 5 * time.Second
+
+// Check is a readiness check of a dependency, like storage backend
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+	// Informational checks are reported as `warn` on failure, without failing readiness
+	Informational bool
+}
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, healthResponse{Status: "ok"})
+}
+
+// readyz runs all the checks in parallel, failing on shutdown
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	res := healthResponse{Status: "ok", Checks: map[string]checkResult{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range s.Checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := checkResult{Status: "ok"}
+			if err := c.Check(ctx); err != nil {
+				result = checkResult{Status: "fail", Error: err.Error()}
+				if c.Informational {
+					result.Status = "warn"
+				}
+			}
+			mu.Lock()
+			res.Checks[c.Name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if s.shuttingDown.Load() {
+		res.Checks["shutdown"] = checkResult{Status: "fail", Error: "shutting down"}
+	}
+	for _, c := range res.Checks {
+		if c.Status == "fail" {
+			res.Status = "fail"
+		}
+	}
+	writeHealth(w, res)
+}
+
+func writeHealth(w http.ResponseWriter, res healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if res.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cancelWait is how long to wait for requests to clean up after cancellation on grace period timeout
+const cancelWait = 5 * time.Second
+
+// Server runs http servers and shuts them down gracefully: fails readiness, waits Delay for endpoints to be updated,
+// stops accepting requests and waits up to GracePeriod for in-flight ones (including background cache fills).
+// Then Stopping context is cancelled, to abort the rest.
+type Server struct {
+	Servers     []*http.Server
+	Checks      []Check // for readiness
+	Delay       time.Duration
+	GracePeriod time.Duration
+	Logger      *slog.Logger
+
+	inflight     atomic.Int64
+	shuttingDown atomic.Bool
+	stopping     context.Context
+	stop         context.CancelFunc
+	once         sync.Once
+}
+
+func (s *Server) init() {
+	s.once.Do(func() {
+		s.stopping, s.stop = context.WithCancel(context.Background())
+	})
+}
+
+// Stopping is cancelled when grace period is over
+func (s *Server) Stopping() context.Context {
+	s.init()
+	return s.stopping
+}
+
+// Handler serves `/healthz` and `/readyz` probes, and tracks in-flight requests of h
+func (s *Server) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			s.healthz(w, r)
+			return
+		case "/readyz":
+			s.readyz(w, r)
+			return
+		}
+		s.inflight.Add(1)
+		defer s.inflight.Add(-1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Run serves all the servers until ctx is done, then shuts down gracefully. Servers with TLSConfig are served with TLS.
+func (s *Server) Run(ctx context.Context) error {
+	s.init()
+	errCh := make(chan error, len(s.Servers))
+	for _, srv := range s.Servers {
+		go func() {
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				errCh <- err
+			}
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	s.Shutdown()
+	return nil
+}
+
+// Shutdown drains the servers
+func (s *Server) Shutdown() {
+	s.init()
+	s.shuttingDown.Store(true)
+	s.Logger.Info("Shutting down", "delay", s.Delay, "gracePeriod", s.GracePeriod)
+	time.Sleep(s.Delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.GracePeriod)
+	defer cancel()
+	for _, srv := range s.Servers {
+		go srv.Shutdown(ctx)
+	}
+	if s.wait(ctx) {
+		s.Logger.Info("All requests finished")
+		return
+	}
+
+	s.Logger.Warn("Grace period is over, cancelling in-flight requests")
+	s.stop()
+	for _, srv := range s.Servers {
+		srv.Close()
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), cancelWait)
+	defer cancel()
+	s.wait(ctx)
+}
+
+// wait returns true if there are no in-flight requests before ctx is done
+func (s *Server) wait(ctx context.Context) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for s.inflight.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
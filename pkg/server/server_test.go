@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert creates self-signed certificate for 127.0.0.1 with CN name
+func writeCert(t *testing.T, dir, name string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "tls.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "tls.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir := t.TempDir()
+	first := writeCert(t, dir, "first")
+	certs := &TLSReloader{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key"), Logger: slog.Default()}
+	assert.NoError(t, certs.Load())
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.TLS = certs.Config()
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(trusted *x509.Certificate) (*http.Response, error) {
+		pool := x509.NewCertPool()
+		pool.AddCert(trusted)
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true}}
+		return c.Get(srv.URL)
+	}
+	resp, err := get(first)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+
+	// rotated
+	second := writeCert(t, dir, "second")
+	os.Chtimes(certs.CertFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	certs.lastCheck = time.Time{}
+	resp, err = get(second)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	// broken files keep the previous cert
+	assert.NoError(t, os.WriteFile(certs.KeyFile, []byte("broken"), 0600))
+	certs.lastCheck = time.Time{}
+	resp, err = get(second)
+	assert.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestShutdown(t *testing.T) {
+	s := &Server{GracePeriod: 200 * time.Millisecond, Logger: slog.Default()}
+	started := make(chan struct{})
+	ts := httptest.NewServer(s.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-s.Stopping().Done() // background fill
+	})))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/readyz")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	go http.Get(ts.URL + "/slow")
+	<-started
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		s.Shutdown()
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	resp, err = http.Get(ts.URL + "/readyz")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, int64(1), s.inflight.Load())
+
+	<-done
+	assert.GreaterOrEqual(t, time.Since(start), s.GracePeriod)
+	assert.Equal(t, int64(0), s.inflight.Load())
+	assert.Error(t, s.Stopping().Err())
+}
+
+func TestReadyz(t *testing.T) {
+	var broken atomic.Bool
+	s := &Server{Logger: slog.Default(), Checks: []Check{
+		{Name: "ok", Check: func(ctx context.Context) error { return nil }},
+		{Name: "storage", Check: func(ctx context.Context) error {
+			if broken.Load() {
+				return errors.New("no space")
+			}
+			return nil
+		}},
+		{Name: "upstream", Informational: true, Check: func(ctx context.Context) error { return errors.New("timeout") }},
+	}}
+	h := s.Handler(http.NotFoundHandler())
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get("/readyz")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"status":"ok","checks":{"ok":{"status":"ok"},"storage":{"status":"ok"},"upstream":{"status":"warn","error":"timeout"}}}`, body)
+
+	broken.Store(true)
+	code, body = get("/readyz")
+	assert.Equal(t, 503, code)
+	assert.JSONEq(t, `{"status":"fail","checks":{"ok":{"status":"ok"},"storage":{"status":"fail","error":"no space"},"upstream":{"status":"warn","error":"timeout"}}}`, body)
+
+	code, body = get("/healthz")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"status":"ok"}`, body)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// tlsCheckInterval is how often cert files are checked for changes on handshakes
+const tlsCheckInterval = 10 * time.Second
+
+var certNotAfter = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "containerd_cache_tls_certificate_not_after_seconds",
+	Help: "Expiration unix time of the currently served TLS certificate",
+})
+
+// TLSReloader serves certificate and client CA from files, reloading them on change (like cert-manager rotation).
+// In case of invalid files on reload, the previous ones are kept.
+type TLSReloader struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string // optional, to verify client certificates if given
+	Logger       *slog.Logger
+
+	mu        sync.Mutex
+	config    *tls.Config
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+// Load reads the files, it should succeed before serving
+func (t *TLSReloader) Load() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.load(t.stat())
+}
+
+// Config returns tls.Config for http.Server, with h2 enabled
+func (t *TLSReloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.current(), nil
+		},
+	}
+}
+
+func (t *TLSReloader) current() *tls.Config {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.lastCheck) < tlsCheckInterval {
+		return t.config
+	}
+	t.lastCheck = time.Now()
+	modTimes := t.stat()
+	if !slices.EqualFunc(modTimes, t.modTimes, time.Time.Equal) {
+		if err := t.load(modTimes); err != nil {
+			t.Logger.Error("Could not reload TLS certificate, keeping the previous one", "error", err)
+		} else {
+			t.Logger.Info("Reloaded TLS certificate", "cert", t.CertFile)
+		}
+	}
+	return t.config
+}
+
+func (t *TLSReloader) load(modTimes []time.Time) error {
+	// store even on failure, to not retry broken files on each handshake
+	t.modTimes = modTimes
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+		Certificates: []tls.Certificate{cert},
+	}
+	if t.ClientCAFile != "" {
+		data, err := os.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New("no certificates found in client CA file")
+		}
+		cfg.ClientCAs = pool
+		// clients without cert could still be allowed by auth token or CIDR
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		certNotAfter.Set(float64(leaf.NotAfter.Unix()))
+	}
+	t.config = cfg
+	return nil
+}
+
+// stat returns modification times of the files, zero for missing ones
+func (t *TLSReloader) stat() []time.Time {
+	var res []time.Time
+	for _, f := range []string{t.CertFile, t.KeyFile, t.ClientCAFile} {
+		var mod time.Time
+		if f != "" {
+			if fi, err := os.Stat(f); err == nil {
+				mod = fi.ModTime()
+			}
+		}
+		res = append(res, mod)
+	}
+	return res
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// https://docs.aws.amazon.com/AmazonECR/latest/userguide/Registries.html
+var ecrHostRe = regexp.MustCompile(`^(\d{12})\.dkr(?:-fips)?\.ecr\.([a-z0-9-]+)\.(?:amazonaws\.com|amazonaws\.com\.cn|on\.aws)$`)
+
+// ecrRefreshBefore is how long before expiry (12h) the token is refreshed
+const ecrRefreshBefore = time.Hour
+
+type ecrAPI interface {
+	GetAuthorizationToken(ctx context.Context, params *ecr.GetAuthorizationTokenInput, optFns ...func(*ecr.Options)) (*ecr.GetAuthorizationTokenOutput, error)
+}
+
+// ECRAuth gets ECR authorization tokens using the default AWS credentials chain (IRSA, envs),
+// optionally assuming a role per account for cross-account pulls
+type ECRAuth struct {
+	Roles map[string]string // account id -> role ARN to assume
+
+	cfg       aws.Config
+	newClient func(account, region string) ecrAPI
+
+	mu     sync.Mutex
+	tokens map[string]cachedCreds
+}
+
+func NewECRAuth(ctx context.Context, roles map[string]string) (*ECRAuth, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load AWS config: %v", err)
+	}
+	e := &ECRAuth{
+		Roles:  roles,
+		cfg:    cfg,
+		tokens: map[string]cachedCreds{},
+	}
+	e.newClient = e.client
+	return e, nil
+}
+
+func (e *ECRAuth) client(account, region string) ecrAPI {
+	cfg := e.cfg.Copy()
+	cfg.Region = region
+	if role, ok := e.Roles[account]; ok {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(e.cfg), role, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = "containerd-registry-cache"
+		}))
+	}
+	return ecr.NewFromConfig(cfg)
+}
+
+// IsECR returns true if host is ECR private registry
+func (e *ECRAuth) IsECR(host string) bool {
+	return e != nil && ecrHostRe.MatchString(host)
+}
+
+// Invalidate drops cached token of the host, like rejected by the registry
+func (e *ECRAuth) Invalidate(host string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.tokens, host)
+}
+
+// Creds returns `AWS` user and token for the ECR host, cached until an hour before expiry
+func (e *ECRAuth) Creds(ctx context.Context, host string) (RegistryCreds, error) {
+	m := ecrHostRe.FindStringSubmatch(host)
+	if e == nil || m == nil {
+		return RegistryCreds{}, fmt.Errorf("`%s` is not an ECR registry", host)
+	}
+
+	e.mu.Lock()
+	cached, ok := e.tokens[host]
+	e.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.creds, nil
+	}
+
+	account, region := m[1], m[2]
+	out, err := e.newClient(account, region).GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return RegistryCreds{}, fmt.Errorf("failed to get ECR token for account %s: %w", account, err)
+	}
+	if len(out.AuthorizationData) == 0 || out.AuthorizationData[0].AuthorizationToken == nil {
+		return RegistryCreds{}, errors.New("no ECR authorization data returned")
+	}
+	data := out.AuthorizationData[0]
+	decoded, err := base64.StdEncoding.DecodeString(*data.AuthorizationToken)
+	if err != nil {
+		return RegistryCreds{}, fmt.Errorf("invalid ECR token: %w", err)
+	}
+	user, pass, _ := strings.Cut(string(decoded), ":")
+	creds := RegistryCreds{Username: user, Password: pass}
+
+	expires := time.Now().Add(12 * time.Hour)
+	if data.ExpiresAt != nil {
+		expires = *data.ExpiresAt
+	}
+	e.mu.Lock()
+	e.tokens[host] = cachedCreds{creds: creds, expires: expires.Add(-ecrRefreshBefore)}
+	e.mu.Unlock()
+	return creds, nil
+}
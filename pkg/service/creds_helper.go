@@ -0,0 +1,227 @@
+package service
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultHelperCacheDuration is used when credential source does not report expiry
+const defaultHelperCacheDuration = 10 * time.Minute
+
+const helperTimeout = 30 * time.Second
+
+// ExecProvider is a kubelet-style credential provider plugin, using CredentialProviderRequest/Response protocol
+// https://kubernetes.io/docs/tasks/administer-cluster/kubelet-credential-provider/
+type ExecProvider struct {
+	Command    string            `json:"command"`
+	Args       []string          `json:"args"`
+	Env        map[string]string `json:"env"`
+	APIVersion string            `json:"apiVersion" yaml:"apiVersion"`
+}
+
+type credentialProviderResponse struct {
+	Kind          string `json:"kind"`
+	CacheKeyType  string `json:"cacheKeyType"` // Image, Registry or Global
+	CacheDuration string `json:"cacheDuration"`
+	Auth          map[string]struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auth"`
+}
+
+type dockerHelperResponse struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+type cachedCreds struct {
+	creds   RegistryCreds
+	expires time.Time
+}
+
+// credsCache keeps credentials from helpers until their expiry
+type credsCache struct {
+	sync.Mutex
+	entries map[string]cachedCreds
+}
+
+var helperCache = &credsCache{entries: map[string]cachedCreds{}}
+
+// get returns creds of the first key not expired
+func (c *credsCache) get(keys ...string) (RegistryCreds, bool) {
+	c.Lock()
+	defer c.Unlock()
+	for _, key := range keys {
+		if cached, ok := c.entries[key]; ok && time.Now().Before(cached.expires) {
+			return cached.creds, true
+		}
+	}
+	return RegistryCreds{}, false
+}
+
+// put stores creds for ttl, evicting the expired ones
+func (c *credsCache) put(key string, creds RegistryCreds, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	for k, cached := range c.entries {
+		if !now.Before(cached.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedCreds{creds: creds, expires: now.Add(ttl)}
+}
+
+// isDynamic returns true if creds should be obtained from external command
+func (c RegistryCreds) isDynamic() bool {
+	return c.Helper != "" || c.Provider != nil
+}
+
+// resolveCreds runs credential helper or provider of creds for the url, caching results until expiry.
+// Provider results are cached per image, registry or globally, as set by its cacheKeyType.
+func resolveCreds(ctx context.Context, creds RegistryCreds, u *url.URL) (RegistryCreds, error) {
+	repo := strings.TrimPrefix(u.Path, "/v2/")
+	for _, sep := range []string{"/manifests/", "/blobs/"} {
+		if i := strings.LastIndex(repo, sep); i != -1 {
+			repo = repo[:i]
+		}
+	}
+	image := u.Host + "/" + repo
+
+	var keys map[string]string // by cacheKeyType
+	if creds.Provider != nil {
+		base := creds.Provider.Command + " " + strings.Join(creds.Provider.Args, " ") + "|"
+		for _, k := range slices.Sorted(maps.Keys(creds.Provider.Env)) {
+			base += k + "=" + creds.Provider.Env[k] + "|"
+		}
+		keys = map[string]string{"Image": base + image, "Registry": base + u.Host, "Global": base}
+	} else {
+		keys = map[string]string{"Registry": creds.Helper + "|" + u.Host}
+	}
+	if cached, ok := helperCache.get(keys["Image"], keys["Registry"], keys["Global"]); ok {
+		return cached, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, helperTimeout)
+	defer cancel()
+	var res RegistryCreds
+	var ttl time.Duration
+	keyType := "Registry"
+	var err error
+	if creds.Provider != nil {
+		res, ttl, keyType, err = runProvider(ctx, creds.Provider, u.Host, image)
+	} else {
+		res, err = runHelper(ctx, creds.Helper, u.Host)
+		ttl = defaultHelperCacheDuration
+	}
+	if err != nil {
+		return RegistryCreds{}, err
+	}
+
+	if ttl > 0 {
+		helperCache.put(keys[keyType], res, ttl)
+	}
+	return res, nil
+}
+
+// runHelper runs `docker-credential-<helper> get`
+// https://github.com/docker/docker-credential-helpers#development
+func runHelper(ctx context.Context, helper, host string) (RegistryCreds, error) {
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// stdout is not logged, as it could have the secret
+		return RegistryCreds{}, fmt.Errorf("credential helper `%s` failed: %w: %s", helper, err, strings.TrimSpace(stderr.String()))
+	}
+
+	resp := dockerHelperResponse{}
+	if err = json.Unmarshal(out, &resp); err != nil {
+		return RegistryCreds{}, fmt.Errorf("credential helper `%s` returned invalid response: %w", helper, err)
+	}
+	if resp.Username == "<token>" {
+		return RegistryCreds{IdentityToken: resp.Secret}, nil
+	}
+	return RegistryCreds{Username: resp.Username, Password: resp.Secret}, nil
+}
+
+// runProvider runs kubelet credential provider plugin, returns creds with their cache duration and key type
+func runProvider(ctx context.Context, p *ExecProvider, host, image string) (RegistryCreds, time.Duration, string, error) {
+	apiVersion := p.APIVersion
+	if apiVersion == "" {
+		apiVersion = "credentialprovider.kubelet.k8s.io/v1"
+	}
+	req, _ := json.Marshal(map[string]string{
+		"apiVersion": apiVersion,
+		"kind":       "CredentialProviderRequest",
+		"image":      image,
+	})
+
+	cmd := exec.CommandContext(ctx, p.Command, p.Args...)
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Env = os.Environ()
+	for k, v := range p.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return RegistryCreds{}, 0, "", fmt.Errorf("credential provider `%s` failed: %w: %s", p.Command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	resp := credentialProviderResponse{}
+	if err = json.Unmarshal(out, &resp); err != nil {
+		return RegistryCreds{}, 0, "", fmt.Errorf("credential provider `%s` returned invalid response: %w", p.Command, err)
+	}
+	if resp.Kind != "CredentialProviderResponse" {
+		return RegistryCreds{}, 0, "", fmt.Errorf("credential provider `%s` returned unexpected kind `%s`", p.Command, resp.Kind)
+	}
+	keyType := cmp.Or(resp.CacheKeyType, "Registry")
+	if keyType != "Image" && keyType != "Registry" && keyType != "Global" {
+		return RegistryCreds{}, 0, "", fmt.Errorf("credential provider `%s` returned unexpected cacheKeyType `%s`", p.Command, resp.CacheKeyType)
+	}
+	ttl := defaultHelperCacheDuration
+	if resp.CacheDuration != "" {
+		if ttl, err = time.ParseDuration(resp.CacheDuration); err != nil {
+			return RegistryCreds{}, 0, "", fmt.Errorf("credential provider `%s` returned invalid cacheDuration: %w", p.Command, err)
+		}
+	}
+
+	// keys are matched like kubelet does, i.e. `*.dkr.ecr.*.amazonaws.com` or `registry.io/path`
+	var bestKey string
+	var best RegistryCreds
+	for k, a := range resp.Auth {
+		match := strings.TrimPrefix(strings.TrimPrefix(k, "https://"), "http://")
+		keyHost, keyPath, _ := strings.Cut(match, "/")
+		if ok, _ := path.Match(keyHost, host); !ok {
+			continue
+		}
+		if keyPath != "" && !strings.HasPrefix(strings.TrimPrefix(image, host+"/"), keyPath) {
+			continue
+		}
+		if len(match) > len(bestKey) {
+			bestKey = match
+			best = RegistryCreds{Username: a.Username, Password: a.Password}
+		}
+	}
+	if bestKey != "" {
+		return best, ttl, keyType, nil
+	}
+	return RegistryCreds{}, 0, "", fmt.Errorf("credential provider `%s` returned no auth for `%s`", p.Command, image)
+}
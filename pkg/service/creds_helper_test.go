@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeScript creates executable script in dir, which logs each call to dir/calls
+func writeScript(t *testing.T, dir, name, body string) string {
+	p := filepath.Join(dir, name)
+	script := "#!/bin/sh\necho call >> " + filepath.Join(dir, "calls") + "\n" + body
+	assert.NoError(t, os.WriteFile(p, []byte(script), 0755))
+	return p
+}
+
+func calls(t *testing.T, dir string) int {
+	data, _ := os.ReadFile(filepath.Join(dir, "calls"))
+	return strings.Count(string(data), "call")
+}
+
+func TestDockerCredentialHelper(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, dir, "docker-credential-fake", `read host
+[ "$1" = get ] || exit 1
+echo "{\"ServerURL\":\"$host\",\"Username\":\"user-$host\",\"Secret\":\"pass\"}"
+`)
+	writeScript(t, dir, "docker-credential-fake-token", `echo '{"ServerURL":"","Username":"<token>","Secret":"refresh"}'`)
+	writeScript(t, dir, "docker-credential-broken", `echo "credentials not found" >&2; exit 1`)
+	writeScript(t, dir, "docker-credential-leaky", `echo '{"Username":"user","Secret":"leaked"}'; exit 1`)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	u, _ := url.Parse("https://helper.example.com/v2/org/repo/manifests/v1")
+	creds, err := resolveCreds(context.Background(), RegistryCreds{Helper: "fake"}, u)
+	assert.NoError(t, err)
+	assert.Equal(t, RegistryCreds{Username: "user-helper.example.com", Password: "pass"}, creds)
+	// cached
+	_, err = resolveCreds(context.Background(), RegistryCreds{Helper: "fake"}, u)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls(t, dir))
+
+	creds, err = resolveCreds(context.Background(), RegistryCreds{Helper: "fake-token"}, u)
+	assert.NoError(t, err)
+	assert.Equal(t, RegistryCreds{IdentityToken: "refresh"}, creds)
+
+	_, err = resolveCreds(context.Background(), RegistryCreds{Helper: "broken"}, u)
+	assert.ErrorContains(t, err, "credentials not found")
+
+	_, err = resolveCreds(context.Background(), RegistryCreds{Helper: "leaky"}, u)
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "leaked")
+}
+
+func TestExecCredentialProvider(t *testing.T) {
+	dir := t.TempDir()
+	provider := writeScript(t, dir, "provider", `read req
+echo "$req" | grep -q '"kind":"CredentialProviderRequest"' || exit 1
+echo "$req" | grep -q '"image":"123.dkr.ecr.eu-west-1.amazonaws.com/org/' || exit 1
+cat <<EOF
+{"kind":"${KIND:-CredentialProviderResponse}","apiVersion":"credentialprovider.kubelet.k8s.io/v1","cacheKeyType":"${KEY:-Registry}","cacheDuration":"$CACHE",
+ "auth":{"*.dkr.ecr.*.amazonaws.com":{"username":"AWS","password":"token"},"other.io":{"username":"x","password":"y"}}}
+EOF
+`)
+	u, _ := url.Parse("https://123.dkr.ecr.eu-west-1.amazonaws.com/v2/org/repo/manifests/v1")
+
+	// cacheDuration 0 disables caching
+	p := &ExecProvider{Command: provider, Env: map[string]string{"CACHE": "0s"}}
+	for range 2 {
+		creds, err := resolveCreds(context.Background(), RegistryCreds{Provider: p}, u)
+		assert.NoError(t, err)
+		assert.Equal(t, RegistryCreds{Username: "AWS", Password: "token"}, creds)
+	}
+	assert.Equal(t, 2, calls(t, dir))
+
+	p = &ExecProvider{Command: provider, Args: []string{"cached"}, Env: map[string]string{"CACHE": "1h"}}
+	for range 2 {
+		_, err := resolveCreds(context.Background(), RegistryCreds{Provider: p}, u)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 3, calls(t, dir))
+
+	sameRegistry, _ := url.Parse("https://123.dkr.ecr.eu-west-1.amazonaws.com/v2/org/other/manifests/v1")
+	_, err := resolveCreds(context.Background(), RegistryCreds{Provider: p}, sameRegistry)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls(t, dir), "cached for the registry")
+
+	p = &ExecProvider{Command: provider, Args: []string{"image"}, Env: map[string]string{"CACHE": "1h", "KEY": "Image"}}
+	for _, u := range []*url.URL{u, u, sameRegistry} {
+		_, err := resolveCreds(context.Background(), RegistryCreds{Provider: p}, u)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 5, calls(t, dir), "cached for the image only")
+
+	// different env is not cached together
+	p = &ExecProvider{Command: provider, Args: []string{"image"}, Env: map[string]string{"CACHE": "1h", "KEY": "Image", "ROLE": "other"}}
+	_, err = resolveCreds(context.Background(), RegistryCreds{Provider: p}, u)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, calls(t, dir))
+
+	p = &ExecProvider{Command: provider, Args: []string{"kind"}, Env: map[string]string{"KIND": "Other"}}
+	_, err = resolveCreds(context.Background(), RegistryCreds{Provider: p}, u)
+	assert.ErrorContains(t, err, "unexpected kind `Other`")
+
+	other, _ := url.Parse("https://ghcr.io/v2/org/repo/manifests/v1")
+	_, err = resolveCreds(context.Background(), RegistryCreds{Provider: p}, other)
+	assert.Error(t, err)
+}
+
+func TestCredsCacheEviction(t *testing.T) {
+	c := &credsCache{entries: map[string]cachedCreds{}}
+	c.put("a", RegistryCreds{Username: "a"}, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	_, ok := c.get("a")
+	assert.False(t, ok)
+	c.put("b", RegistryCreds{Username: "b"}, time.Hour)
+	assert.Len(t, c.entries, 1, "expired entries are evicted")
+	creds, ok := c.get("a", "b")
+	assert.True(t, ok)
+	assert.Equal(t, "b", creds.Username)
+}
+
+type fakeECR struct {
+	calls     int
+	account   string
+	region    string
+	passwords []string // returned by calls, `secret` when empty
+}
+
+func (f *fakeECR) GetAuthorizationToken(ctx context.Context, params *ecr.GetAuthorizationTokenInput, optFns ...func(*ecr.Options)) (*ecr.GetAuthorizationTokenOutput, error) {
+	f.calls++
+	password := "secret"
+	if len(f.passwords) != 0 {
+		password = f.passwords[f.calls-1]
+	}
+	token := base64.StdEncoding.EncodeToString([]byte("AWS:" + password))
+	return &ecr.GetAuthorizationTokenOutput{AuthorizationData: []ecrtypes.AuthorizationData{{
+		AuthorizationToken: &token,
+		ExpiresAt:          aws.Time(time.Now().Add(12 * time.Hour)),
+	}}}, nil
+}
+
+func TestECRAuth(t *testing.T) {
+	var nilAuth *ECRAuth
+	assert.False(t, nilAuth.IsECR("123456789012.dkr.ecr.eu-west-1.amazonaws.com"))
+
+	fake := &fakeECR{}
+	e := &ECRAuth{tokens: map[string]cachedCreds{}, newClient: func(account, region string) ecrAPI {
+		fake.account, fake.region = account, region
+		return fake
+	}}
+	assert.True(t, e.IsECR("123456789012.dkr.ecr.eu-west-1.amazonaws.com"))
+	assert.True(t, e.IsECR("123456789012.dkr-fips.ecr.us-east-1.amazonaws.com"))
+	assert.False(t, e.IsECR("public.ecr.aws"))
+	assert.False(t, e.IsECR("ghcr.io"))
+
+	for range 2 {
+		creds, err := e.Creds(context.Background(), "123456789012.dkr.ecr.eu-west-1.amazonaws.com")
+		assert.NoError(t, err)
+		assert.Equal(t, RegistryCreds{Username: "AWS", Password: "secret"}, creds)
+	}
+	assert.Equal(t, 1, fake.calls)
+	assert.Equal(t, "123456789012", fake.account)
+	assert.Equal(t, "eu-west-1", fake.region)
+
+	_, err := e.Creds(context.Background(), "ghcr.io")
+	assert.Error(t, err)
+}
+
+func TestECRTokenRejected(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Basic "+base64.StdEncoding.EncodeToString([]byte("AWS:new")) {
+			w.WriteHeader(200)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="ecr"`)
+		w.WriteHeader(401)
+	}))
+	defer srv.Close()
+
+	// ECR hostname resolved to the test server
+	tr := srv.Client().Transport.(*http.Transport).Clone()
+	tr.TLSClientConfig.InsecureSkipVerify = true
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	origClient := client
+	client = &http.Client{Transport: tr}
+	defer func() { client = origClient }()
+
+	fake := &fakeECR{passwords: []string{"revoked", "new"}}
+	s := &CacheService{ECR: &ECRAuth{tokens: map[string]cachedCreds{}, newClient: func(account, region string) ecrAPI { return fake }}}
+	logger := slog.Default()
+	resp, err := s.reqWithCreds(context.Background(), "https://123456789012.dkr.ecr.eu-west-1.amazonaws.com/v2/org/repo/manifests/v1", "GET", &http.Header{}, &logger)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 2, fake.calls, "rejected token is dropped from cache")
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sepich/containerd-registry-cache/pkg/accesslog"
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+	"github.com/sepich/containerd-registry-cache/pkg/upstream"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "containerd_cache_requests_total",
+	Help: "Client requests by cache result: hit, stale, miss, skip, error",
+}, []string{"registry", "repository", "type", "result", "backend"})
+
+var bytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "containerd_cache_bytes_total",
+	Help: "Bytes served to clients by source: cache or upstream",
+}, []string{"registry", "repository", "type", "source", "backend"})
+
+var lookupDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "containerd_cache_lookup_duration_seconds",
+	Help:    "Time to look up the object in cache",
+	Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+}, []string{"type", "backend"})
+
+var upstreamTTFB = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "containerd_cache_upstream_ttfb_seconds",
+	Help:    "Time to upstream response headers, including auth",
+	Buckets: prometheus.ExponentialBuckets(0.01, 3, 8),
+}, []string{"registry", "type"})
+
+var transferDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "containerd_cache_transfer_duration_seconds",
+	Help:    "Time to transfer response body by source: cache or upstream",
+	Buckets: prometheus.ExponentialBuckets(0.01, 4, 9),
+}, []string{"registry", "type", "source"})
+
+var inflightTransfers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "containerd_cache_inflight_transfers",
+	Help: "Response bodies being transferred by source: cache or upstream",
+}, []string{"registry", "type", "source"})
+
+// registryLabels is shared with upstream metrics, as upstream hosts come from clients too
+var registryLabels = upstream.HostLabels
+var repositoryLabels = &upstream.LabelSet{Max: upstream.MaxLabelValues}
+
+// objectMetrics records metrics of a client request for the object, and attributes of its trace span
+type objectMetrics struct {
+	registry   string
+	repository string // empty unless enabled by RepositoryMetrics
+	objType    string
+	backend    string
+	span       trace.Span
+	entry      *accesslog.Entry // nil if access log is disabled
+}
+
+func (s *CacheService) metrics(ctx context.Context, object *model.ObjectIdentifier) objectMetrics {
+	m := objectMetrics{
+		registry: registryLabels.Value(object.Registry),
+		objType:  string(object.Type),
+		backend:  cache.Backend(s.Cache),
+		span:     trace.SpanFromContext(ctx),
+		entry:    accesslog.FromContext(ctx),
+	}
+	if s.RepositoryMetrics {
+		m.repository = repositoryLabels.Value(object.Registry + "/" + object.Repository)
+	}
+	return m
+}
+
+func (m objectMetrics) result(result string) {
+	requestsTotal.WithLabelValues(m.registry, m.repository, m.objType, result, m.backend).Inc()
+	m.span.SetAttributes(attribute.String("cache.result", result), attribute.String("cache.backend", m.backend))
+	if m.entry != nil {
+		m.entry.Cache = result
+	}
+}
+
+func (m objectMetrics) lookup(start time.Time) {
+	lookupDuration.WithLabelValues(m.objType, m.backend).Observe(time.Since(start).Seconds())
+}
+
+func (m objectMetrics) ttfb(upstream string, start time.Time) {
+	d := time.Since(start)
+	upstreamTTFB.WithLabelValues(registryLabels.Value(upstream), m.objType).Observe(d.Seconds())
+	if m.entry != nil {
+		m.entry.TTFB = d
+	}
+}
+
+// upstreamBytes records size of upstream response body read
+func (m objectMetrics) upstreamBytes(n int64) {
+	m.span.SetAttributes(attribute.Int64("upstream.bytes", n))
+	if m.entry != nil {
+		m.entry.UpstreamBytes = n
+	}
+}
+
+// transfer wraps body copy from source, returns writer counting bytes sent to client and func to call when done
+func (m objectMetrics) transfer(source string, w io.Writer) (io.Writer, func()) {
+	start := time.Now()
+	inflight := inflightTransfers.WithLabelValues(m.registry, m.objType, source)
+	inflight.Inc()
+	counted := &countingWriter{w: w, c: bytesTotal.WithLabelValues(m.registry, m.repository, m.objType, source, m.backend)}
+	return counted, func() {
+		inflight.Dec()
+		transferDuration.WithLabelValues(m.registry, m.objType, source).Observe(time.Since(start).Seconds())
+		m.span.SetAttributes(attribute.Int64("transfer.bytes", counted.n))
+	}
+}
+
+// countingReader counts bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts bytes written to w, and adds them to optional c
+type countingWriter struct {
+	w io.Writer
+	c prometheus.Counter
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if c.c != nil {
+		c.c.Add(float64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var upstreamResumes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "containerd_cache_upstream_resumes_total",
+	Help: "Attempts to resume interrupted upstream downloads via Range requests",
+}, []string{"result"})
+
+var errNotResumable = errors.New("upstream did not return expected range")
+
+// resumeReader reads upstream response body, and on read errors re-requests the same url
+// with `Range: bytes=<read>-` to continue from the last received byte.
+// Retries are the budget for the whole body, so an upstream dropping connections is not resumed forever.
+type resumeReader struct {
+	resp     *http.Response
+	body     io.ReadCloser
+	read     int64
+	retries  int
+	attempts int
+	backoff  time.Duration
+	logger   *slog.Logger
+
+	wait  func(ctx context.Context) error      // rate limit of the upstream, optional
+	track func(resp *http.Response, err error) // health and metrics of the upstream, optional
+}
+
+func newResumeReader(resp *http.Response, retries int, backoff time.Duration, logger *slog.Logger) *resumeReader {
+	return &resumeReader{
+		resp:    resp,
+		body:    resp.Body,
+		retries: retries,
+		backoff: backoff,
+		logger:  logger,
+	}
+}
+
+func (r *resumeReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.read += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	for r.attempts < r.retries {
+		wait := r.backoff << r.attempts
+		r.attempts++
+		r.logger.Warn("Upstream read failed, resuming", "error", err, "offset", r.read, "attempt", r.attempts, "wait", wait)
+		select {
+		case <-time.After(wait):
+		case <-r.resp.Request.Context().Done():
+			return n, err
+		}
+		body, rerr := r.reopen()
+		if rerr == nil {
+			upstreamResumes.WithLabelValues("success").Inc()
+			r.body.Close()
+			r.body = body
+			return n, nil
+		}
+		upstreamResumes.WithLabelValues("failure").Inc()
+		if errors.Is(rerr, errNotResumable) {
+			r.logger.Warn("Upstream can't resume download", "error", rerr)
+			break
+		}
+		r.logger.Warn("Upstream resume request failed", "error", rerr)
+	}
+	return n, err
+}
+
+// reopen requests the rest of the body from the final (after redirects) url of the original request
+func (r *resumeReader) reopen() (io.ReadCloser, error) {
+	ctx := r.resp.Request.Context()
+	if r.wait != nil {
+		if err := r.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	headers := r.resp.Request.Header.Clone()
+	headers.Set("Range", fmt.Sprintf("bytes=%d-", r.read))
+	resp, err := request(ctx, r.resp.Request.URL.String(), "GET", &headers)
+	if r.track != nil {
+		r.track(resp, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var start int64
+	if resp.StatusCode == 206 {
+		_, err = fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start)
+	}
+	if resp.StatusCode != 206 || err != nil || start != r.read {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: status %d, content-range `%s`", errNotResumable, resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+	return resp.Body, nil
+}
+
+// originalURL returns url of the request before redirects, like to the upstream instead of its CDN
+func originalURL(resp *http.Response) *url.URL {
+	req := resp.Request
+	for req.Response != nil {
+		req = req.Response.Request
+	}
+	return req.URL
+}
+
+func (r *resumeReader) Close() error {
+	return r.body.Close()
+}
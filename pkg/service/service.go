@@ -6,7 +6,6 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -14,25 +13,53 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sepich/containerd-registry-cache/pkg/accesslog"
 	"github.com/sepich/containerd-registry-cache/pkg/cache"
 	"github.com/sepich/containerd-registry-cache/pkg/model"
+	"github.com/sepich/containerd-registry-cache/pkg/upstream"
+	"github.com/sepich/containerd-registry-cache/pkg/usage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Service interface {
-	GetObject(object *model.ObjectIdentifier, isHead bool, headers *http.Header, w http.ResponseWriter, logger *slog.Logger)
+	GetObject(ctx context.Context, object *model.ObjectIdentifier, isHead bool, headers *http.Header, w http.ResponseWriter, logger *slog.Logger)
 }
 
 type RegistryCreds struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username      string        `json:"username"`
+	Password      string        `json:"password"`
+	IdentityToken string        `json:"identitytoken"` // OAuth2 refresh token, exchanged for access token at the Bearer realm
+	Token         string        `json:"token"`         // Bearer token used as-is
+	Helper        string        `json:"helper"`        // Suffix of docker-credential-<helper> binary to get creds from
+	Provider      *ExecProvider `json:"provider"`      // Kubelet credential provider plugin to get creds from
+}
+
+// String returns non-secret identifier of creds for logs
+func (c RegistryCreds) String() string {
+	switch {
+	case c.Helper != "":
+		return "<helper:" + c.Helper + ">"
+	case c.Provider != nil:
+		return "<provider:" + path.Base(c.Provider.Command) + ">"
+	case c.Token != "":
+		return "<token>"
+	case c.IdentityToken != "":
+		return "<identitytoken>"
+	}
+	return c.Username
 }
 
 var client = &http.Client{
@@ -53,6 +80,8 @@ var client = &http.Client{
 	},
 }
 
+var tracer = otel.Tracer("github.com/sepich/containerd-registry-cache/pkg/service")
+
 var cacheHits = promauto.NewCounter(prometheus.CounterOpts{
 	Name:        "containerd_cache_total",
 	ConstLabels: map[string]string{"result": "hit"},
@@ -65,6 +94,19 @@ var cacheSkips = promauto.NewCounter(prometheus.CounterOpts{
 	Name:        "containerd_cache_total",
 	ConstLabels: map[string]string{"result": "skip"},
 })
+var cacheStale = promauto.NewCounter(prometheus.CounterOpts{
+	Name:        "containerd_cache_total",
+	ConstLabels: map[string]string{"result": "stale"},
+})
+var upstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "containerd_cache_upstream_requests_total",
+	Help: "Requests to upstreams by response status code",
+}, []string{"upstream", "status"})
+
+var backgroundFills = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "containerd_cache_background_fills_total",
+	Help: "Cache fills continued after client disconnect, see --fill-timeout",
+}, []string{"result"})
 
 var pool = sync.Pool{
 	New: func() any {
@@ -79,112 +121,197 @@ type CacheService struct {
 	SkipTags          *regexp.Regexp
 	DefaultCreds      map[string]RegistryCreds
 	CacheManifests    bool
-	PrivateRegistries map[string]bool
+	PrivateRegistries map[string]bool // by registry or registry/repo prefix
+	Upstreams         *upstream.Rewriter
+	Health            *upstream.Health
+	Retries           int           // attempts to resume interrupted blob download
+	RetryBackoff      time.Duration // initial delay between resume attempts, doubled on each one
+	RateLimiter       *upstream.RateLimiter
+	ServeStale        bool                     // save skipped manifests to serve them when upstream is rate limited
+	FillTimeout       time.Duration            // detach cache fill from client request, to let it finish in background
+	ManifestTTL       time.Duration            // refetch cached manifests older than this, 0 to keep forever
+	RegistryTTLs      map[string]time.Duration // by registry or registry/repo prefix
+	ECR               *ECRAuth                 // native auth for ECR hosts without creds configured
+	Stopping          context.Context          // cancels background cache fills on shutdown, optional
+	RepositoryMetrics bool                     // add repository label to metrics
+	Usage             *usage.Index             // records hits and stores, optional
+	VerifyMaxSize     int64                    // verify digest of cached objects up to this size before serving, 0 to disable
+	AccessLog         bool                     // requests are logged by accesslog, so served lines are debug
 }
 
 var _ Service = &CacheService{}
 
-func (s *CacheService) GetObject(object *model.ObjectIdentifier, isHead bool, headers *http.Header, w http.ResponseWriter, logger *slog.Logger) {
+// ReloadableService serves requests with the last stored CacheService, to swap configuration atomically.
+// In-flight requests finish with the configuration they started with.
+type ReloadableService struct {
+	current atomic.Pointer[CacheService]
+}
+
+var _ Service = &ReloadableService{}
+
+func (r *ReloadableService) Store(s *CacheService) {
+	r.current.Store(s)
+}
+
+func (r *ReloadableService) Load() *CacheService {
+	return r.current.Load()
+}
+
+func (r *ReloadableService) GetObject(ctx context.Context, object *model.ObjectIdentifier, isHead bool, headers *http.Header, w http.ResponseWriter, logger *slog.Logger) {
+	r.current.Load().GetObject(ctx, object, isHead, headers, w, logger)
+}
+
+func (s *CacheService) GetObject(ctx context.Context, object *model.ObjectIdentifier, isHead bool, headers *http.Header, w http.ResponseWriter, logger *slog.Logger) {
 	w.Header().Add("X-Proxied-By", "containerd-registry-cache")
 	w.Header().Add("X-Proxied-For", object.Registry)
 
+	m := s.metrics(ctx, object)
 	skipCacheReason := s.getSkipReason(object)
 	var cacheWriter cache.CacheWriter
-	if skipCacheReason == "" {
+	var stale cache.CachedObject
+	if skipCacheReason == "" || s.canServeStale(object) {
 		var cached cache.CachedObject
 		var err error
-		cached, cacheWriter, err = s.Cache.GetCache(object)
+		start := time.Now()
+		lookupCtx, span := tracer.Start(ctx, "cache.lookup", trace.WithAttributes(attribute.String("cache.backend", m.backend)))
+		cached, cacheWriter, err = s.Cache.GetCache(lookupCtx, object)
+		endSpan(span, err)
+		m.lookup(start)
 		if err != nil {
 			logger.Error("error getting from cache", "error", err)
+			m.result("error")
 			w.WriteHeader(500)
 			return
 		}
 
+		if cached != nil && !isHead && s.VerifyMaxSize > 0 && cached.GetMetadata().SizeBytes <= s.VerifyMaxSize {
+			cached = s.verify(ctx, object, cached, logger)
+		}
 		if cached != nil {
-			meta := cached.GetMetadata()
-			logger.Info("Served from cache", "cache", "hit", slog.Group("cached",
-				"origin", meta.Registry+"/"+meta.Repository,
-				"type", meta.Type,
-				"date", meta.CacheDate,
-				"size", meta.SizeBytes,
-				"content-type", meta.ContentType,
-				"content-digest", meta.DockerContentDigest,
-				"path", meta.Path,
-			))
-			cacheHits.Inc()
-
-			w.Header().Add("X-Proxy-Date", meta.CacheDate.String())
-			w.Header().Add("Age", strconv.Itoa(int(time.Since(meta.CacheDate).Seconds())))
-			w.Header().Add(model.HeaderContentLength, strconv.Itoa(int(meta.SizeBytes)))
-			w.Header().Add(model.HeaderContentType, meta.ContentType)
-			if meta.DockerContentDigest != "" {
-				w.Header().Add(model.HeaderDockerContentDigest, meta.DockerContentDigest)
-			}
-			logger.Debug("Client response", "headers", w.Header())
-
-			if !isHead {
-				reader, _ := cached.GetReader()
-				defer reader.Close()
-				if err = readIntoWriters([]io.Writer{w}, reader); err != nil {
-					logger.Error("Error reading body from cache", "error", err)
-					return
+			if skipCacheReason != "" || s.expired(cached.GetMetadata()) {
+				stale = cached // only served when upstream is rate limited
+			} else {
+				serveCached(ctx, cached, "hit", isHead, w, m, s.servedLevel(), logger)
+				if s.Usage != nil {
+					s.Usage.Access(object, cached.GetMetadata().SizeBytes, !isHead)
 				}
+				return
 			}
-			return
 		}
 		// will cache response for all, but some clients can dislike zstd/gzip, so cache as raw full-range
 		headers.Del("Accept-Encoding")
 		headers.Del("Range")
 	}
 
-	url := "https://%s/v2/%s/blobs/%s"
-	if object.Type == model.ObjectTypeManifest {
-		url = "https://%s/v2/%s/manifests/%s"
+	// a miss could be fetched and saved to cache even if the client is gone
+	fillCtx := ctx
+	if cacheWriter != nil && s.FillTimeout > 0 {
+		var cancel context.CancelFunc
+		fillCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), s.FillTimeout)
+		defer cancel()
+		if s.Stopping != nil {
+			defer context.AfterFunc(s.Stopping, cancel)()
+		}
 	}
 
-	upstreamResp, err := s.reqWithCreds(fmt.Sprintf(url, object.Registry, object.Repository, object.Ref), "GET", headers, &logger)
+	upstreamResp, err := s.reqUpstreams(fillCtx, object, headers, m, &logger)
+	if errors.Is(err, upstream.ErrRateLimited) || (err == nil && upstreamResp.StatusCode == 429) {
+		if stale != nil {
+			if upstreamResp != nil {
+				upstreamResp.Body.Close()
+			}
+			w.Header().Add("Warning", `110 - "Response is Stale"`)
+			serveCached(ctx, stale, "stale", isHead, w, m, s.servedLevel(), logger)
+			if s.Usage != nil {
+				s.Usage.Access(object, stale.GetMetadata().SizeBytes, !isHead)
+			}
+			return
+		}
+		if err != nil {
+			logger.Warn("Upstream request rate limited", "error", err)
+			m.result("error")
+			w.WriteHeader(429)
+			return
+		}
+	}
 	if err != nil {
 		logger.Error("Error proxying request", "error", err)
+		m.result("error")
 		w.WriteHeader(500)
 		return
 	}
 	defer upstreamResp.Body.Close()
 
-	logger.Debug("Upstream response", "status", upstreamResp.StatusCode, "headers", upstreamResp.Header)
+	logger.Debug("Upstream response", "status", upstreamResp.StatusCode, "headers", accesslog.Redact(upstreamResp.Header))
 	copyHeaders(w.Header(), upstreamResp.Header)
 	w.WriteHeader(upstreamResp.StatusCode)
 	// If it's a non-200 status from upstream then don't cache
 	// This should handle 404s and 401s to request auth
 	if upstreamResp.StatusCode/100 != 2 {
 		skipCacheReason = "non-2xx upstream response"
+		cacheWriter = nil
 	}
 
 	var manifestBytes bytes.Buffer
 	sha := sha256.New()
 	writers := []io.Writer{}
-	if skipCacheReason == "" {
-		logger = logger.With("cache", "miss")
-		cacheMisses.Inc()
-		writers = append(writers, cacheWriter, sha)
+	// skipped manifests are still saved when they could be served stale later
+	store := cacheWriter != nil
+	stored := &countingWriter{w: cacheWriter}
+	if store {
+		writers = append(writers, stored, sha)
 		defer cacheWriter.Cleanup()
 		if object.Type == model.ObjectTypeManifest {
 			writers = append(writers, &manifestBytes)
 		}
+	}
+	if skipCacheReason == "" {
+		logger = logger.With("cache", "miss")
+		cacheMisses.Inc()
+		m.result("miss")
 	} else {
 		logger = logger.With("cache", "skip", "reason", skipCacheReason)
 		cacheSkips.Inc()
+		m.result("skip")
 	}
+	var cw *clientWriter
 	if !isHead {
-		writers = append(writers, w)
+		counted, done := m.transfer("upstream", w)
+		defer done()
+		if store && s.FillTimeout > 0 {
+			// client disconnect should not abort the cache fill
+			cw = &clientWriter{w: counted}
+			writers = append(writers, cw)
+		} else {
+			writers = append(writers, counted)
+		}
 	}
 
-	err = readIntoWriters(writers, upstreamResp.Body)
+	var body io.Reader = upstreamResp.Body
+	// blobs can be large, so resume interrupted downloads instead of failing the client
+	if object.Type == model.ObjectTypeBlob && upstreamResp.StatusCode == 200 && headers.Get("Range") == "" && s.Retries > 0 {
+		rr := newResumeReader(upstreamResp, s.Retries, s.RetryBackoff, logger)
+		// resumes count against rate limit and health of the upstream, as any other request to it
+		u := originalURL(upstreamResp)
+		rr.wait = func(ctx context.Context) error { return s.waitRateLimit(ctx, u.String(), u.Host) }
+		rr.track = func(resp *http.Response, err error) { s.trackUpstream(u.Host, resp, err, logger) }
+		defer rr.Close()
+		body = rr
+	}
+	counted := &countingReader{r: body}
+	err = readIntoWriters(writers, counted)
+	m.upstreamBytes(counted.n)
+	fillResult := "failure"
+	if cw != nil && cw.err != nil {
+		logger = logger.With("client_error", cw.err)
+		defer func() { backgroundFills.WithLabelValues(fillResult).Inc() }()
+	}
 	if err != nil {
 		logger.Error("Error while reading upstream response body", "error", err)
 		return // don't cache on error
 	}
 
-	if skipCacheReason == "" {
+	if store {
 		if object.Type == model.ObjectTypeManifest {
 			logger.Debug("Upstream returned manifest", "manifest", manifestBytes.Bytes())
 		}
@@ -201,11 +328,231 @@ func (s *CacheService) GetObject(object *model.ObjectIdentifier, isHead bool, he
 				return
 			}
 		}
-		if err = cacheWriter.Close(upstreamResp.Header.Get(model.HeaderContentType), cd); err != nil {
+		storeCtx, span := tracer.Start(fillCtx, "cache.store", trace.WithAttributes(
+			attribute.String("cache.backend", m.backend),
+			attribute.Int64("oci.size", stored.n),
+		))
+		err = cacheWriter.Close(storeCtx, upstreamResp.Header.Get(model.HeaderContentType), cd)
+		endSpan(span, err)
+		if err != nil {
 			logger.Error("Error saving to cache", "error", err)
+			return
+		}
+		if s.Usage != nil {
+			s.Usage.Stored(object, stored.n, manifestBytes.Bytes())
+		}
+	}
+	fillResult = "success"
+	if cw != nil && cw.err != nil {
+		logger.Info("Client disconnected, cache fill finished in background", "status", upstreamResp.StatusCode)
+		return
+	}
+	logger.Log(ctx, s.servedLevel(), "Served from upstream", "status", upstreamResp.StatusCode)
+}
+
+// servedLevel is the log level of served lines, info unless duplicated by access log
+func (s *CacheService) servedLevel() slog.Level {
+	if s.AccessLog {
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+// clientWriter stops writing to the client after the first failure, so that cache fill could continue without it
+type clientWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (c *clientWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return len(p), nil
+	}
+	n, err := c.w.Write(p)
+	if err != nil {
+		c.err = err
+		return len(p), nil
+	}
+	return n, nil
+}
+
+// verify returns cached object buffered after digest check, or nil to fetch it from upstream instead.
+// Corrupt object is evicted, so that it is not served even if upstream fails, while read errors are only logged.
+func (s *CacheService) verify(ctx context.Context, object *model.ObjectIdentifier, cached cache.CachedObject, logger *slog.Logger) cache.CachedObject {
+	verified, err := verifyCached(ctx, object, cached)
+	if err == nil {
+		return verified
+	}
+	logger.Warn("Cached object failed verification, fetching from upstream", "error", err)
+	if store, ok := s.Cache.(cache.Store); ok && errors.Is(err, errCorrupt) {
+		key := cache.ObjectToCacheName(object)
+		if err := store.Delete(ctx, key); err != nil {
+			logger.Error("Could not evict cached object", "key", key, "error", err)
+		} else if s.Usage != nil {
+			s.Usage.Remove(key)
 		}
 	}
-	logger.Info("Served from upstream", "status", upstreamResp.StatusCode)
+	return nil
+}
+
+// serveCached writes cached object to the client
+func serveCached(ctx context.Context, cached cache.CachedObject, result string, isHead bool, w http.ResponseWriter, m objectMetrics, level slog.Level, logger *slog.Logger) {
+	meta := cached.GetMetadata()
+	logger.Log(ctx, level, "Served from cache", "cache", result, slog.Group("cached",
+		"origin", meta.Registry+"/"+meta.Repository,
+		"type", meta.Type,
+		"date", meta.CacheDate,
+		"size", meta.SizeBytes,
+		"content-type", meta.ContentType,
+		"content-digest", meta.DockerContentDigest,
+		"path", meta.Path,
+	))
+	if result == "stale" {
+		cacheStale.Inc()
+	} else {
+		cacheHits.Inc()
+	}
+	m.result(result)
+
+	w.Header().Add("X-Proxy-Date", meta.CacheDate.String())
+	w.Header().Add("Age", strconv.Itoa(int(time.Since(meta.CacheDate).Seconds())))
+	w.Header().Add(model.HeaderContentLength, strconv.Itoa(int(meta.SizeBytes)))
+	w.Header().Add(model.HeaderContentType, meta.ContentType)
+	if meta.DockerContentDigest != "" {
+		w.Header().Add(model.HeaderDockerContentDigest, meta.DockerContentDigest)
+	}
+	logger.Debug("Client response", "headers", accesslog.Redact(w.Header()))
+
+	if !isHead {
+		reader, err := cached.GetReader(ctx)
+		if err != nil {
+			logger.Error("Error reading body from cache", "error", err)
+			w.WriteHeader(500)
+			return
+		}
+		defer reader.Close()
+		counted, done := m.transfer("cache", w)
+		defer done()
+		if err = readIntoWriters([]io.Writer{counted}, reader); err != nil {
+			logger.Error("Error reading body from cache", "error", err)
+			return
+		}
+	}
+}
+
+// reqUpstreams tries upstreams of the object in order, moving to the next one on connection errors,
+// 404 (mirrors have partial content), 429 and 5xx. Response of the last upstream is returned as-is.
+func (s *CacheService) reqUpstreams(ctx context.Context, object *model.ObjectIdentifier, headers *http.Header, m objectMetrics, l **slog.Logger) (*http.Response, error) {
+	urlFormat := "https://%s/v2/%s/blobs/%s"
+	if object.Type == model.ObjectTypeManifest {
+		urlFormat = "https://%s/v2/%s/manifests/%s"
+	}
+
+	// client token is issued by the registry containerd addressed, for the repository requested
+	origin := upstream.Target{Registry: model.LegacyRegistry(object.Registry), Repository: object.Repository}
+	targets := s.Health.Filter(s.Upstreams.Resolve(object.Registry, object.Repository))
+	for i, t := range targets {
+		// each upstream gets own copy, as default creds are set into headers
+		h := headers.Clone()
+		if t != origin {
+			h.Del("Authorization") // mirrors use own creds
+		}
+		logger := *l
+		if len(targets) > 1 || t.Registry != object.Registry {
+			logger = logger.With("upstream", t.Registry)
+		}
+		targetUrl := fmt.Sprintf(urlFormat, t.Registry, t.Repository, object.Ref)
+
+		var resp *http.Response
+		var failed bool
+		err := s.waitRateLimit(ctx, targetUrl, t.Registry)
+		if err == nil {
+			start := time.Now()
+			reqCtx, span := tracer.Start(ctx, "upstream.request", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+				attribute.String("upstream", t.Registry),
+				attribute.String("url.full", targetUrl),
+			))
+			resp, err = s.reqWithCreds(reqCtx, targetUrl, "GET", &h, &logger)
+			if err == nil {
+				m.ttfb(t.Registry, start)
+				span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+			}
+			endSpan(span, err)
+			failed = s.trackUpstream(t.Registry, resp, err, logger)
+		}
+		if i == len(targets)-1 {
+			*l = logger
+			return resp, err
+		}
+		if err != nil {
+			logger.Warn("Upstream request failed, trying next one", "error", err)
+			continue
+		}
+		if failed || resp.StatusCode == 404 {
+			resp.Body.Close()
+			logger.Warn("Upstream request failed, trying next one", "status", resp.StatusCode)
+			continue
+		}
+		*l = logger
+		return resp, nil
+	}
+	return nil, errors.New("no upstreams configured")
+}
+
+// trackUpstream updates metrics and health of the upstream, returns true if the response is a failure
+func (s *CacheService) trackUpstream(host string, resp *http.Response, err error, logger *slog.Logger) bool {
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	upstreamRequests.WithLabelValues(registryLabels.Value(host), status).Inc()
+
+	if err == nil && resp.StatusCode == 429 {
+		s.RateLimiter.Pause(host, upstream.ParseRetryAfter(resp.Header.Get("Retry-After")))
+	}
+	if err != nil || resp.StatusCode == 429 || resp.StatusCode/100 == 5 {
+		if s.Health.Failure(host) {
+			logger.Warn("Upstream is failing, skipping it", "cooldown", s.Health.Cooldown)
+		}
+		return true
+	}
+	s.Health.Success(host)
+	return false
+}
+
+// waitRateLimit blocks until request to upstream is allowed by rate limiter
+func (s *CacheService) waitRateLimit(ctx context.Context, targetUrl, registry string) error {
+	var credsKey string
+	if u, err := url.Parse(targetUrl); err == nil {
+		_, credsKey, _ = s.findCreds(u)
+	}
+	return s.RateLimiter.Wait(ctx, registry, credsKey)
+}
+
+// expired returns true if cached manifest by tag is older than its TTL
+func (s *CacheService) expired(meta cache.ObjMeta) bool {
+	// manifests by digest are immutable
+	if meta.Type != model.ObjectTypeManifest || strings.HasPrefix(meta.Ref, "sha256:") {
+		return false
+	}
+	ttl, ok := model.MatchPrefix(s.RegistryTTLs, meta.Registry, meta.Repository)
+	if !ok {
+		ttl = s.ManifestTTL
+	}
+	return ttl > 0 && time.Since(meta.CacheDate) > ttl
+}
+
+// canServeStale returns true if manifest skipped from caching could still be saved to be served when upstream is rate limited.
+// Manifests of private registries and ignored images are never saved.
+func (s *CacheService) canServeStale(object *model.ObjectIdentifier) bool {
+	if !s.ServeStale || object.Type != model.ObjectTypeManifest {
+		return false
+	}
+	if private, _ := model.MatchPrefix(s.PrivateRegistries, object.Registry, object.Repository); private {
+		return false
+	}
+	_, ignoredImage := s.SkipImages[object.Repository]
+	return !ignoredImage
 }
 
 func (s *CacheService) getSkipReason(object *model.ObjectIdentifier) (res string) {
@@ -220,10 +567,8 @@ func (s *CacheService) getSkipReason(object *model.ObjectIdentifier) (res string
 				res = "tag match skip regex"
 			}
 		}
-		if s.PrivateRegistries != nil {
-			if _, isPrivate := s.PrivateRegistries[object.Registry]; isPrivate {
-				res = "private registry"
-			}
+		if private, _ := model.MatchPrefix(s.PrivateRegistries, object.Registry, object.Repository); private {
+			res = "private registry"
 		}
 		if _, ignoredImage := s.SkipImages[object.Repository]; ignoredImage {
 			res = "image on ignore list"
@@ -261,6 +606,15 @@ func readIntoWriters(dst []io.Writer, src io.Reader) error {
 	}
 }
 
+// endSpan records err if any and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
 func copyHeaders(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -289,70 +643,101 @@ func (s *CacheService) findCreds(u *url.URL) (RegistryCreds, string, bool) {
 	return RegistryCreds{}, "", false
 }
 
-func (s *CacheService) reqWithCreds(url, method string, headers *http.Header, l **slog.Logger) (*http.Response, error) {
-	resp, err := request(url, method, headers)
+func (s *CacheService) reqWithCreds(ctx context.Context, reqUrl, method string, headers *http.Header, l **slog.Logger) (*http.Response, error) {
+	resp, err := request(ctx, reqUrl, method, headers)
 	if err != nil {
 		return nil, err
 	}
 
 	// retry once with default creds if none provided
 	if resp.StatusCode == 401 && headers.Get("Authorization") == "" {
-		if defaultCreds, matchedKey, ok := s.findCreds(resp.Request.URL); ok {
-			(*l).Debug("Received 401, retrying with default credentials", "url", url)
-			*l = (*l).With("creds", defaultCreds.Username+"@"+matchedKey)
-			realm := resp.Header.Get("WWW-Authenticate")
-			if strings.HasPrefix(realm, "Basic") {
-				headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(defaultCreds.Username+":"+defaultCreds.Password)))
-				resp, err = request(url, method, headers)
-				if err != nil {
-					return nil, err
-				}
+		defaultCreds, matchedKey, ok := s.findCreds(resp.Request.URL)
+		credsName := defaultCreds.String() + "@" + matchedKey
+		ecr := !ok && s.ECR.IsECR(resp.Request.URL.Host)
+		if ecr {
+			credsName = "<ecr>@" + resp.Request.URL.Host
+		}
+		if ok || ecr {
+			(*l).Debug("Received 401, retrying with default credentials", "url", reqUrl)
+			*l = (*l).With("creds", credsName)
+			authCtx, span := tracer.Start(ctx, "auth.token", trace.WithAttributes(attribute.String("auth.creds", credsName)))
+			auth, err := s.authorize(authCtx, resp, defaultCreds, ecr)
+			endSpan(span, err)
+			if err != nil {
+				(*l).Warn("Could not authenticate, passing 401 to the client", "error", err)
+				return resp, nil
 			}
-			if strings.HasPrefix(realm, "Bearer") {
-				params := make(map[string]string)
-				for param := range strings.SplitSeq(realm[len("Bearer"):], ",") {
-					tmp := strings.SplitN(strings.TrimSpace(param), "=", 2)
-					if len(tmp) != 2 {
-						continue
-					}
-					params[tmp[0]] = strings.Trim(tmp[1], "\"")
-				}
-				tokenUrl := params["realm"] + "?"
-				for k, v := range params {
-					tokenUrl += k + "=" + v + "&"
-				}
-				tokenUrl = tokenUrl[:len(tokenUrl)-1]
-
-				theaders := http.Header{
-					"Authorization": []string{"Basic " + base64.StdEncoding.EncodeToString([]byte(defaultCreds.Username+":"+defaultCreds.Password))},
-				}
-				tokenResp, err := request(tokenUrl, "GET", &theaders)
-				if err != nil {
-					return nil, err
-				}
-				body, err := io.ReadAll(tokenResp.Body)
-				if err != nil {
-					return nil, err
-				}
-				tokenResp.Body.Close()
-				data := map[string]string{}
-				json.Unmarshal(body, &data) // only parse out strings, skip ints
-				if data["token"] == "" {
-					return nil, errors.New("token not found in response")
-				}
-				headers.Set("Authorization", "Bearer "+data["token"])
-				resp, err = request(url, method, headers)
-				if err != nil {
-					return nil, err
-				}
+			if auth == "" {
+				return resp, nil
+			}
+			resp.Body.Close()
+			headers.Set("Authorization", auth)
+			resp, err = request(ctx, reqUrl, method, headers)
+			if err != nil || resp.StatusCode != 401 || !ecr {
+				return resp, err
 			}
+			// cached token could be revoked, like when the role is changed
+			(*l).Debug("ECR token is rejected, retrying with a new one", "url", reqUrl)
+			s.ECR.Invalidate(resp.Request.URL.Host)
+			if auth, err = s.authorize(ctx, resp, defaultCreds, ecr); err != nil || auth == "" {
+				return resp, nil
+			}
+			resp.Body.Close()
+			headers.Set("Authorization", auth)
+			return request(ctx, reqUrl, method, headers)
 		}
 	}
 	return resp, err
 }
 
-func request(url, method string, headers *http.Header) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(context.TODO(), method, url, nil)
+// authorize returns Authorization header value for the 401 response challenge, using creds.
+// Empty value is returned for unsupported challenge. With ecr, creds are obtained via ECRAuth instead.
+func (s *CacheService) authorize(ctx context.Context, resp *http.Response, creds RegistryCreds, ecr bool) (string, error) {
+	var err error
+	if ecr {
+		creds, err = s.ECR.Creds(ctx, resp.Request.URL.Host)
+	} else if creds.isDynamic() {
+		creds, err = resolveCreds(ctx, creds, resp.Request.URL)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not get credentials: %w", err)
+	}
+
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch {
+	case creds.Token != "":
+		return "Bearer " + creds.Token, nil
+	case strings.EqualFold(scheme, "Basic"):
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(creds.Username+":"+creds.Password)), nil
+	case strings.EqualFold(scheme, "Bearer"):
+		token, err := fetchToken(ctx, params, creds)
+		if err != nil {
+			return "", fmt.Errorf("could not get token: %w", err)
+		}
+		return "Bearer " + token, nil
+	}
+	return "", nil
+}
+
+// PingUpstream checks the registry API of upstream host is reachable, 401 is fine
+func PingUpstream(ctx context.Context, host string) error {
+	resp, err := request(ctx, "https://"+host+"/v2/", "GET", &http.Header{})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("upstream %s responded %d", host, resp.StatusCode)
+	}
+	return nil
+}
+
+func request(ctx context.Context, url, method string, headers *http.Header) (*http.Response, error) {
+	return requestWithBody(ctx, url, method, headers, nil)
+}
+
+func requestWithBody(ctx context.Context, url, method string, headers *http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
@@ -1,10 +1,35 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+	"github.com/sepich/containerd-registry-cache/pkg/tracing"
+	"github.com/sepich/containerd-registry-cache/pkg/upstream"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestFindCreds(t *testing.T) {
@@ -60,3 +85,518 @@ func TestFindCredsTrailingSlash(t *testing.T) {
 	assert.Equal(t, "registry.example.com/project/", key)
 	assert.Equal(t, creds, got)
 }
+
+func TestReqUpstreamsFailover(t *testing.T) {
+	failing := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer failing.Close()
+	var gotPath string
+	healthy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.WriteHeader(200)
+	}))
+	defer healthy.Close()
+
+	origClient := client
+	client = healthy.Client()
+	defer func() { client = origClient }()
+
+	upstreams, err := upstream.NewRewriter([]string{
+		"docker.io=" + failing.Listener.Addr().String() + "," + healthy.Listener.Addr().String() + "/proxy",
+	})
+	assert.NoError(t, err)
+	s := &CacheService{
+		Upstreams: upstreams,
+		Health:    upstream.NewHealth(1, time.Hour),
+	}
+	object := &model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: "3.20", Type: model.ObjectTypeManifest}
+
+	logger := slog.Default()
+	resp, err := s.reqUpstreams(context.Background(), object, &http.Header{}, s.metrics(context.Background(), object), &logger)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/v2/proxy/library/alpine/manifests/3.20", gotPath)
+	assert.False(t, s.Health.Available(failing.Listener.Addr().String()))
+}
+
+func TestReqUpstreamsFailoverCreds(t *testing.T) {
+	var originAuth string
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originAuth = r.Header.Get("Authorization")
+		w.WriteHeader(503)
+	}))
+	defer origin.Close()
+	var mirrorAuth []string
+	mirror := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorAuth = append(mirrorAuth, r.Header.Get("Authorization"))
+		if user, pass, ok := r.BasicAuth(); ok && user == "mirror" && pass == "pass" {
+			w.WriteHeader(200)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="mirror"`)
+		w.WriteHeader(401)
+	}))
+	defer mirror.Close()
+
+	// httptest servers share the certificate
+	origClient := client
+	client = mirror.Client()
+	defer func() { client = origClient }()
+
+	originHost, mirrorHost := origin.Listener.Addr().String(), mirror.Listener.Addr().String()
+	upstreams, err := upstream.NewRewriter([]string{originHost + "=" + originHost + "," + mirrorHost})
+	assert.NoError(t, err)
+	s := &CacheService{
+		Upstreams:    upstreams,
+		DefaultCreds: map[string]RegistryCreds{mirrorHost: {Username: "mirror", Password: "pass"}},
+	}
+	object := &model.ObjectIdentifier{Registry: originHost, Repository: "org/repo", Ref: "v1", Type: model.ObjectTypeManifest}
+
+	logger := slog.Default()
+	headers := http.Header{"Authorization": []string{"Bearer client-token"}}
+	resp, err := s.reqUpstreams(context.Background(), object, &headers, s.metrics(context.Background(), object), &logger)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "Bearer client-token", originAuth)
+	assert.Equal(t, []string{"", "Basic bWlycm9yOnBhc3M="}, mirrorAuth, "client token is not sent to mirror")
+}
+
+func TestResumeReader(t *testing.T) {
+	blob := bytes.Repeat([]byte("0123456789"), 100000)
+	var requests []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Get("Range"))
+		if r.Header.Get("Range") == "" {
+			w.Header().Set(model.HeaderContentLength, strconv.Itoa(len(blob)))
+			w.Write(blob[:len(blob)/3])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler) // drop connection mid-stream
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer srv.Close()
+
+	origClient := client
+	client = srv.Client()
+	defer func() { client = origClient }()
+
+	resp, err := request(context.Background(), srv.URL+"/v2/library/alpine/blobs/sha256:abc", "GET", &http.Header{})
+	assert.NoError(t, err)
+	rr := newResumeReader(resp, 2, time.Millisecond, slog.Default())
+	defer rr.Close()
+
+	got, err := io.ReadAll(rr)
+	assert.NoError(t, err)
+	assert.Equal(t, blob, got)
+	assert.Len(t, requests, 2)
+	assert.Regexp(t, `^bytes=\d+-$`, requests[1])
+}
+
+func TestResumeReaderBudget(t *testing.T) {
+	blob := bytes.Repeat([]byte("0123456789"), 100000)
+	var requests int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		var start int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+		if start != 0 {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(blob)-1, len(blob)))
+			w.WriteHeader(206)
+		}
+		w.Write(blob[start : start+1000])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler) // drops every connection after a few KB
+	}))
+	defer srv.Close()
+
+	origClient := client
+	client = srv.Client()
+	defer func() { client = origClient }()
+
+	resp, err := request(context.Background(), srv.URL+"/v2/library/alpine/blobs/sha256:abc", "GET", &http.Header{})
+	assert.NoError(t, err)
+	rr := newResumeReader(resp, 3, time.Millisecond, slog.Default())
+	var waits, tracked int
+	rr.wait = func(ctx context.Context) error { waits++; return nil }
+	rr.track = func(resp *http.Response, err error) { tracked++ }
+	defer rr.Close()
+
+	_, err = io.ReadAll(rr)
+	assert.Error(t, err, "retries are not reset by successful resumes")
+	assert.Equal(t, 4, requests)
+	assert.Equal(t, 3, waits)
+	assert.Equal(t, 3, tracked)
+	assert.Equal(t, srv.URL+"/v2/library/alpine/blobs/sha256:abc", originalURL(resp).String())
+}
+
+type disconnectedWriter struct {
+	httptest.ResponseRecorder
+}
+
+func (w *disconnectedWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("client disconnected")
+}
+
+func TestBackgroundFill(t *testing.T) {
+	blob := bytes.Repeat([]byte("0123456789"), 1000)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(blob)
+	}))
+	defer srv.Close()
+
+	origClient := client
+	client = srv.Client()
+	defer func() { client = origClient }()
+
+	upstreams, err := upstream.NewRewriter([]string{"docker.io=" + srv.Listener.Addr().String()})
+	assert.NoError(t, err)
+	fileCache := &cache.FileCache{CacheDirectory: t.TempDir()}
+	object := &model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: digest, Type: model.ObjectTypeBlob}
+
+	for _, fillTimeout := range []time.Duration{0, time.Minute} {
+		s := &CacheService{
+			Cache:       fileCache,
+			Upstreams:   upstreams,
+			FillTimeout: fillTimeout,
+		}
+		s.GetObject(context.Background(), object, false, &http.Header{}, &disconnectedWriter{}, slog.Default())
+
+		cached, _, err := fileCache.GetCache(context.Background(), object)
+		assert.NoError(t, err)
+		if fillTimeout == 0 {
+			assert.Nil(t, cached, "client disconnect aborts cache fill")
+		} else {
+			assert.NotNil(t, cached, "cache fill continues without client")
+		}
+	}
+}
+
+// cancellingWriter is a client abandoning the pull after the first bytes received, only its context is cancelled
+type cancellingWriter struct {
+	httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w *cancellingWriter) Write(b []byte) (int, error) {
+	w.cancel()
+	return len(b), nil
+}
+
+func TestCancelFill(t *testing.T) {
+	blob := bytes.Repeat([]byte("0123456789"), 100000)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+	aborted := make(chan bool, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(blob[:len(blob)/2])
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			aborted <- true
+		case <-time.After(100 * time.Millisecond):
+			w.Write(blob[len(blob)/2:])
+			aborted <- false
+		}
+	}))
+	defer srv.Close()
+
+	origClient := client
+	client = srv.Client()
+	defer func() { client = origClient }()
+
+	upstreams, err := upstream.NewRewriter([]string{"docker.io=" + srv.Listener.Addr().String()})
+	assert.NoError(t, err)
+	object := &model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: digest, Type: model.ObjectTypeBlob}
+
+	for _, fillTimeout := range []time.Duration{0, time.Minute} {
+		dir := t.TempDir()
+		fileCache := &cache.FileCache{CacheDirectory: dir}
+		s := &CacheService{
+			Cache:       fileCache,
+			Upstreams:   upstreams,
+			FillTimeout: fillTimeout,
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		s.GetObject(ctx, object, false, &http.Header{}, &cancellingWriter{cancel: cancel}, slog.Default())
+
+		cached, _, err := fileCache.GetCache(context.Background(), object)
+		assert.NoError(t, err)
+		entries, err := os.ReadDir(dir)
+		assert.NoError(t, err)
+		if fillTimeout == 0 {
+			assert.True(t, <-aborted, "upstream request is cancelled with the client")
+			assert.Nil(t, cached)
+			assert.Empty(t, entries, "temp file is removed")
+		} else {
+			assert.False(t, <-aborted, "upstream request is detached from the client")
+			assert.NotNil(t, cached)
+			assert.Equal(t, int64(len(blob)), cached.GetMetadata().SizeBytes)
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	s := &CacheService{
+		ManifestTTL:  time.Hour,
+		RegistryTTLs: map[string]time.Duration{"ghcr.io": time.Minute},
+	}
+	meta := func(registry, ref string, t model.ObjectType, age time.Duration) cache.ObjMeta {
+		return cache.ObjMeta{CacheManifest: cache.CacheManifest{
+			ObjectIdentifier: model.ObjectIdentifier{Registry: registry, Ref: ref, Type: t},
+			CacheDate:        time.Now().Add(-age),
+		}}
+	}
+
+	assert.False(t, s.expired(meta("docker.io", "3.20", model.ObjectTypeManifest, 30*time.Minute)))
+	assert.True(t, s.expired(meta("docker.io", "3.20", model.ObjectTypeManifest, 2*time.Hour)))
+	assert.True(t, s.expired(meta("ghcr.io", "3.20", model.ObjectTypeManifest, 30*time.Minute)))
+	assert.False(t, s.expired(meta("docker.io", "sha256:abc", model.ObjectTypeManifest, 2*time.Hour)), "digests are immutable")
+	assert.False(t, s.expired(meta("docker.io", "sha256:abc", model.ObjectTypeBlob, 2*time.Hour)))
+}
+
+func TestReqWithIdentityToken(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			r.ParseForm()
+			if r.Method != "POST" || r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh" ||
+				r.PostForm.Get("scope") != "repository:org/repo:pull" {
+				w.WriteHeader(401)
+				return
+			}
+			w.Write([]byte(`{"access_token": "access", "expires_in": 300}`))
+		case r.Header.Get("Authorization") == "Bearer access":
+			w.WriteHeader(200)
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="registry",scope="repository:org/repo:pull"`)
+			w.WriteHeader(401)
+		}
+	}))
+	defer srv.Close()
+
+	origClient := client
+	client = srv.Client()
+	defer func() { client = origClient }()
+
+	host := srv.Listener.Addr().String()
+	s := &CacheService{
+		DefaultCreds: map[string]RegistryCreds{host: {IdentityToken: "refresh"}},
+	}
+	logger := slog.Default()
+	resp, err := s.reqWithCreds(context.Background(), "https://"+host+"/v2/org/repo/manifests/v1", "GET", &http.Header{}, &logger)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:org/repo:pull,push"`)
+	assert.Equal(t, "Bearer", scheme)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:org/repo:pull,push",
+	}, params)
+
+	scheme, params = parseChallenge(`Basic realm="Registry \"Realm\""`)
+	assert.Equal(t, "Basic", scheme)
+	assert.Equal(t, map[string]string{"realm": `Registry "Realm"`}, params)
+
+	_, params = parseChallenge(`Bearer realm=https://auth, service=reg`)
+	assert.Equal(t, map[string]string{"realm": "https://auth", "service": "reg"}, params)
+}
+
+func TestFetchToken(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			user, pass, _ := r.BasicAuth()
+			q := r.URL.Query()
+			if r.Method != "GET" || user != "user" || pass != "p&ss" || q.Get("service") != "reg istry" ||
+				!assert.ObjectsAreEqual([]string{"repository:a/b:pull", "repository:c/d:pull"}, q["scope"]) {
+				w.WriteHeader(401)
+				return
+			}
+			w.Write([]byte(`{"token": "get"}`))
+		case "/anonymous":
+			if r.URL.Query().Has("account") || r.Header.Get("Authorization") != "" {
+				w.WriteHeader(400)
+				return
+			}
+			w.Write([]byte(`{"token": "anonymous"}`))
+		case "/oauth2/token":
+			if r.Method != "POST" {
+				w.WriteHeader(405)
+				return
+			}
+			r.ParseForm()
+			if r.PostForm.Get("grant_type") != "password" || r.PostForm.Get("username") != "user" || r.PostForm.Get("password") != "p&ss" {
+				w.WriteHeader(401)
+				return
+			}
+			w.Write([]byte(`{"access_token": "post"}`))
+		}
+	}))
+	defer srv.Close()
+
+	origClient := client
+	client = srv.Client()
+	defer func() { client = origClient }()
+
+	creds := RegistryCreds{Username: "user", Password: "p&ss"}
+	params := map[string]string{"realm": srv.URL + "/token", "service": "reg istry", "scope": "repository:a/b:pull repository:c/d:pull"}
+	token, err := fetchToken(context.Background(), params, creds)
+	assert.NoError(t, err)
+	assert.Equal(t, "get", token)
+
+	params["realm"] = srv.URL + "/oauth2/token"
+	token, err = fetchToken(context.Background(), params, creds)
+	assert.NoError(t, err)
+	assert.Equal(t, "post", token)
+
+	_, err = fetchToken(context.Background(), params, RegistryCreds{Username: "user", Password: "wrong"})
+	assert.ErrorContains(t, err, "returned 401")
+
+	params["realm"] = srv.URL + "/anonymous"
+	token, err = fetchToken(context.Background(), params, RegistryCreds{})
+	assert.NoError(t, err)
+	assert.Equal(t, "anonymous", token, "no account without username")
+}
+
+func TestMetrics(t *testing.T) {
+	blob := bytes.Repeat([]byte("0123456789"), 1000)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(blob)
+	}))
+	defer srv.Close()
+
+	origClient := client
+	client = srv.Client()
+	defer func() { client = origClient }()
+
+	registry := srv.Listener.Addr().String()
+	s := &CacheService{Cache: &cache.FileCache{CacheDirectory: t.TempDir()}, RepositoryMetrics: true}
+	object := &model.ObjectIdentifier{Registry: registry, Repository: "library/alpine", Ref: digest, Type: model.ObjectTypeBlob}
+	for range 2 {
+		s.GetObject(context.Background(), object, false, &http.Header{}, httptest.NewRecorder(), slog.Default())
+	}
+
+	repo := registry + "/library/alpine"
+	assert.Equal(t, 1.0, testutil.ToFloat64(requestsTotal.WithLabelValues(registry, repo, "blob", "miss", "file")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(requestsTotal.WithLabelValues(registry, repo, "blob", "hit", "file")))
+	assert.Equal(t, float64(len(blob)), testutil.ToFloat64(bytesTotal.WithLabelValues(registry, repo, "blob", "upstream", "file")))
+	assert.Equal(t, float64(len(blob)), testutil.ToFloat64(bytesTotal.WithLabelValues(registry, repo, "blob", "cache", "file")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(inflightTransfers.WithLabelValues(registry, "blob", "upstream")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(upstreamRequests.WithLabelValues(registry, "200")))
+}
+
+func TestTracing(t *testing.T) {
+	// in-process OTLP/HTTP collector
+	spans := make(chan *tracepb.Span, 100)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		assert.NoError(t, proto.Unmarshal(body, req))
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					spans <- span
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+	shutdown, err := tracing.Setup(context.Background(), collector.URL, 1)
+	assert.NoError(t, err)
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			w.Write([]byte(`{"token": "access"}`))
+		case r.Header.Get("Authorization") == "Bearer access":
+			w.Write([]byte("{}"))
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="registry"`)
+			w.WriteHeader(401)
+		}
+	}))
+	defer srv.Close()
+	origClient := client
+	client = srv.Client()
+	defer func() { client = origClient }()
+
+	host := srv.Listener.Addr().String()
+	s := &CacheService{
+		Cache:          &cache.FileCache{CacheDirectory: t.TempDir()},
+		CacheManifests: true,
+		DefaultCreds:   map[string]RegistryCreds{host: {Username: "user", Password: "pass"}},
+	}
+	traceID := "0af7651916cd43dd8448eb211c80319c"
+	headers := http.Header{"Traceparent": []string{"00-" + traceID + "-b7ad6b7169203331-01"}}
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(headers))
+	object := &model.ObjectIdentifier{Registry: host, Repository: "org/repo", Ref: "v1", Type: model.ObjectTypeManifest}
+	s.GetObject(ctx, object, false, &http.Header{}, httptest.NewRecorder(), slog.Default())
+	assert.NoError(t, shutdown(context.Background()))
+	close(spans)
+
+	names := map[string]bool{}
+	for span := range spans {
+		assert.Equal(t, traceID, hex.EncodeToString(span.TraceId))
+		names[span.Name] = true
+	}
+	assert.Equal(t, map[string]bool{"cache.lookup": true, "upstream.request": true, "auth.token": true, "cache.store": true}, names)
+}
+
+func TestVerifyCached(t *testing.T) {
+	blob := bytes.Repeat([]byte("0123456789"), 100)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+	var upstreamHits int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits++
+		w.Write(blob)
+	}))
+	defer srv.Close()
+
+	origClient := client
+	client = srv.Client()
+	defer func() { client = origClient }()
+
+	fileCache := &cache.FileCache{CacheDirectory: t.TempDir()}
+	s := &CacheService{Cache: fileCache, VerifyMaxSize: 1 << 10}
+	object := &model.ObjectIdentifier{Registry: srv.Listener.Addr().String(), Repository: "library/alpine", Ref: digest, Type: model.ObjectTypeBlob}
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.GetObject(context.Background(), object, false, &http.Header{}, w, slog.Default())
+		return w
+	}
+
+	get()
+	w := get()
+	assert.Equal(t, 1, upstreamHits, "verified hit")
+	assert.Equal(t, blob, w.Body.Bytes())
+	assert.Equal(t, 1.0, testutil.ToFloat64(verifiedHits.WithLabelValues("blob", "ok")))
+
+	path := filepath.Join(fileCache.CacheDirectory, cache.ObjectToCacheName(object))
+	assert.NoError(t, os.WriteFile(path, bytes.Repeat([]byte("x"), len(blob)), 0644))
+	w = get()
+	assert.Equal(t, 2, upstreamHits, "corrupt hit is fetched from upstream")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, blob, w.Body.Bytes())
+	assert.Equal(t, 1.0, testutil.ToFloat64(verifiedHits.WithLabelValues("blob", "corrupt")))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, blob, data, "cached again")
+
+	s.VerifyMaxSize = 100
+	assert.NoError(t, os.WriteFile(path, bytes.Repeat([]byte("x"), len(blob)), 0644))
+	get()
+	assert.Equal(t, 2, upstreamHits, "larger objects are not verified")
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+)
+
+const tokenClientID = "containerd-registry-cache"
+
+// parseChallenge parses `WWW-Authenticate` header like `Bearer realm="https://auth",service="registry",scope="a:b:pull,push"`
+// Commas are allowed inside quoted values
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		var value string
+		if strings.HasPrefix(after, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(after) && after[i] != '"'; i++ {
+				if after[i] == '\\' && i+1 < len(after) {
+					i++
+				}
+				b.WriteByte(after[i])
+			}
+			value, rest = b.String(), after[min(i+1, len(after)):]
+		} else {
+			value, rest, _ = strings.Cut(after, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
+
+// fetchToken gets bearer token from the challenge realm
+// https://distribution.github.io/distribution/spec/auth/token/
+// https://distribution.github.io/distribution/spec/auth/oauth/
+func fetchToken(ctx context.Context, params map[string]string, creds RegistryCreds) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid token realm `%s`", params["realm"])
+	}
+	// multiple scopes are space separated in the challenge, and sent as repeated params
+	scopes := strings.Fields(params["scope"])
+
+	if creds.IdentityToken != "" {
+		return postToken(ctx, realm.String(), url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {creds.IdentityToken},
+			"service":       {params["service"]},
+			"scope":         scopes,
+			"client_id":     {tokenClientID},
+		})
+	}
+
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	for _, scope := range scopes {
+		query.Add("scope", scope)
+	}
+	headers := http.Header{}
+	// some realms reject empty account
+	if creds.Username != "" {
+		query.Set("account", creds.Username)
+		headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(creds.Username+":"+creds.Password)))
+	}
+	realm.RawQuery = query.Encode()
+	resp, err := request(ctx, realm.String(), "GET", &headers)
+	if err != nil {
+		return "", err
+	}
+	// OAuth2-only token servers do not implement GET
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		resp.Body.Close()
+		return postToken(ctx, params["realm"], url.Values{
+			"grant_type": {"password"},
+			"username":   {creds.Username},
+			"password":   {creds.Password},
+			"service":    {params["service"]},
+			"scope":      scopes,
+			"client_id":  {tokenClientID},
+		})
+	}
+	return readToken(resp)
+}
+
+func postToken(ctx context.Context, realm string, form url.Values) (string, error) {
+	headers := http.Header{model.HeaderContentType: []string{"application/x-www-form-urlencoded"}}
+	resp, err := requestWithBody(ctx, realm, "POST", &headers, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	return readToken(resp)
+}
+
+// readToken parses token response, `token` or OAuth2 `access_token`
+func readToken(resp *http.Response) (string, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("token request to %s returned %d", resp.Request.URL.Host, resp.StatusCode)
+	}
+	var data struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", fmt.Errorf("invalid token response: %w", err)
+	}
+	if data.Token != "" {
+		return data.Token, nil
+	}
+	if data.AccessToken != "" {
+		return data.AccessToken, nil
+	}
+	return "", fmt.Errorf("token not found in response")
+}
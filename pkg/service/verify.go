@@ -0,0 +1,72 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+)
+
+var verifiedHits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "containerd_cache_verify_total",
+	Help: "Cache hits verified against digest before serving, see --verify-max-kb: ok, corrupt, error",
+}, []string{"type", "result"})
+
+var errCorrupt = errors.New("cached object is corrupt")
+
+// verifyCached reads the cached object into memory and checks it against its digest, so that nothing is sent to
+// the client before it is known to be correct. Returns the buffered object to serve, or error when it is corrupt.
+// Objects without known digest (tags cached without Docker-Content-Digest) are returned as-is.
+func verifyCached(ctx context.Context, object *model.ObjectIdentifier, cached cache.CachedObject) (cache.CachedObject, error) {
+	meta := cached.GetMetadata()
+	meta.ObjectIdentifier = *object
+	expected := cache.ExpectedDigest(meta)
+	if expected == "" {
+		return cached, nil
+	}
+	reader, err := cached.GetReader(ctx)
+	if err != nil {
+		verifiedHits.WithLabelValues(string(object.Type), "error").Inc()
+		return nil, err
+	}
+	defer reader.Close()
+	// one more byte to detect content longer than metadata says
+	body, err := io.ReadAll(io.LimitReader(reader, meta.SizeBytes+1))
+	if err != nil {
+		verifiedHits.WithLabelValues(string(object.Type), "error").Inc()
+		return nil, err
+	}
+	if int64(len(body)) != meta.SizeBytes {
+		verifiedHits.WithLabelValues(string(object.Type), "corrupt").Inc()
+		return nil, fmt.Errorf("%w, size mismatch, expected %d, actual %d", errCorrupt, meta.SizeBytes, len(body))
+	}
+	sum := sha256.Sum256(body)
+	if actual := "sha256:" + hex.EncodeToString(sum[:]); actual != expected {
+		verifiedHits.WithLabelValues(string(object.Type), "corrupt").Inc()
+		return nil, fmt.Errorf("%w, digest mismatch, expected %s, actual %s", errCorrupt, expected, actual)
+	}
+	verifiedHits.WithLabelValues(string(object.Type), "ok").Inc()
+	return &verifiedObject{meta: cached.GetMetadata(), body: body}, nil
+}
+
+// verifiedObject serves already verified content from memory
+type verifiedObject struct {
+	meta cache.ObjMeta
+	body []byte
+}
+
+func (v *verifiedObject) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(v.body)), nil
+}
+
+func (v *verifiedObject) GetMetadata() cache.ObjMeta {
+	return v.meta
+}
@@ -0,0 +1,106 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var upstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "containerd_cache_upstream_healthy",
+	Help: "Whether upstream is used (1) or temporarily skipped due to failures (0)",
+}, []string{"upstream"})
+
+// Health provides passive health tracking of upstreams: after Threshold consecutive failures
+// the upstream is skipped for Cooldown, then tried again.
+type Health struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu    sync.Mutex
+	state map[string]*endpointState
+}
+
+type endpointState struct {
+	failures  int
+	skipUntil time.Time
+}
+
+func NewHealth(threshold int, cooldown time.Duration) *Health {
+	return &Health{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		state:     map[string]*endpointState{},
+	}
+}
+
+// Available returns false while the upstream is in cooldown
+func (h *Health) Available(upstream string) bool {
+	if h == nil || h.Threshold <= 0 {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.state[upstream]
+	return !ok || time.Now().After(st.skipUntil)
+}
+
+// Success resets failures counter of the upstream
+func (h *Health) Success(upstream string) {
+	if h == nil || h.Threshold <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.state, upstream) // not to keep state of every host clients asked for
+	upstreamHealthy.WithLabelValues(HostLabels.Value(upstream)).Set(1)
+}
+
+// Failure counts a failure, and returns true when the upstream is put into cooldown
+func (h *Health) Failure(upstream string) bool {
+	if h == nil || h.Threshold <= 0 {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.state[upstream]
+	if !ok {
+		h.evictExpired()
+		st = &endpointState{}
+		h.state[upstream] = st
+	}
+	st.failures++
+	if st.failures < h.Threshold {
+		return false
+	}
+	st.failures = 0
+	st.skipUntil = time.Now().Add(h.Cooldown)
+	upstreamHealthy.WithLabelValues(HostLabels.Value(upstream)).Set(0)
+	return true
+}
+
+// evictExpired removes upstreams which are out of cooldown without new failures. Should be called with mu held.
+func (h *Health) evictExpired() {
+	now := time.Now()
+	for upstream, st := range h.state {
+		if st.failures == 0 && now.After(st.skipUntil) {
+			delete(h.state, upstream)
+		}
+	}
+}
+
+// Filter returns targets which are not in cooldown, or all of them if none is available
+func (h *Health) Filter(targets []Target) []Target {
+	res := make([]Target, 0, len(targets))
+	for _, t := range targets {
+		if h.Available(t.Registry) {
+			res = append(res, t)
+		}
+	}
+	if len(res) == 0 {
+		return targets
+	}
+	return res
+}
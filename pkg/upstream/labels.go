@@ -0,0 +1,34 @@
+package upstream
+
+import "sync"
+
+// MaxLabelValues bounds cardinality of registry, upstream and repository labels, as they come from clients.
+// Values seen after the limit is reached are reported as `other`.
+const MaxLabelValues = 100
+
+// HostLabels bounds registry and upstream host label values of all the metrics
+var HostLabels = &LabelSet{Max: MaxLabelValues}
+
+// LabelSet passes first Max label values as-is, and replaces the rest with `other`
+type LabelSet struct {
+	Max int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func (l *LabelSet) Value(v string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[v]; ok {
+		return v
+	}
+	if len(l.seen) >= l.Max {
+		return "other"
+	}
+	if l.seen == nil {
+		l.seen = map[string]struct{}{}
+	}
+	l.seen[v] = struct{}{}
+	return v
+}
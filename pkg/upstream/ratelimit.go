@@ -0,0 +1,209 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+var ErrRateLimited = errors.New("upstream rate limit exceeded")
+
+var rateLimitTokens = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "containerd_cache_ratelimit_tokens",
+	Help: "Tokens available in rate limiter bucket",
+}, []string{"upstream"})
+var rateLimitPaused = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "containerd_cache_ratelimit_paused_until_seconds",
+	Help: "Unix time until which requests to upstream are paused due to 429 Retry-After",
+}, []string{"upstream"})
+var rateLimitWaits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "containerd_cache_ratelimit_waits_total",
+	Help: "Requests passed (ok) or rejected (limited) by rate limiter",
+}, []string{"upstream", "result"})
+
+// Limit is a token-bucket rate limit for an upstream
+type Limit struct {
+	Upstream string // upstream host, or `*` for all of them
+	RPS      float64
+	Burst    int
+}
+
+// ParseLimit parses `upstream=rps[:burst]`, e.g. `registry-1.docker.io=0.5:10`
+func ParseLimit(s string) (Limit, error) {
+	host, spec, ok := strings.Cut(s, "=")
+	host = strings.TrimSpace(host)
+	if !ok || host == "" {
+		return Limit{}, fmt.Errorf("invalid rate limit `%s`, expected `upstream=rps[:burst]`", s)
+	}
+	rps, burst, hasBurst := strings.Cut(spec, ":")
+	l := Limit{Upstream: host, Burst: 1}
+	var err error
+	if l.RPS, err = strconv.ParseFloat(rps, 64); err != nil || l.RPS <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit `%s`, rps should be a positive number", s)
+	}
+	if hasBurst {
+		if l.Burst, err = strconv.Atoi(burst); err != nil || l.Burst <= 0 {
+			return Limit{}, fmt.Errorf("invalid rate limit `%s`, burst should be a positive integer", s)
+		}
+	}
+	return l, nil
+}
+
+// RateLimiter throttles requests to upstreams with token buckets, and pauses them when upstream asks to via Retry-After
+type RateLimiter struct {
+	limits   map[string]Limit
+	perCreds bool          // separate bucket for each credentials key
+	maxWait  time.Duration // max time to wait for a token
+
+	mu          sync.Mutex
+	buckets     map[string]*rate.Limiter
+	pausedUntil map[string]time.Time
+}
+
+func NewRateLimiter(limits []Limit, perCreds bool, maxWait time.Duration) *RateLimiter {
+	l := &RateLimiter{
+		limits:      map[string]Limit{},
+		perCreds:    perCreds,
+		maxWait:     maxWait,
+		buckets:     map[string]*rate.Limiter{},
+		pausedUntil: map[string]time.Time{},
+	}
+	for _, limit := range limits {
+		l.limits[limit.Upstream] = limit
+	}
+	return l
+}
+
+// Wait blocks until request to upstream is allowed, or returns ErrRateLimited if that would take longer than maxWait.
+// With zero maxWait requests are not delayed, but only allowed when there is a token. When ctx is done meanwhile,
+// its error is returned as-is.
+func (l *RateLimiter) Wait(ctx context.Context, upstream, credsKey string) error {
+	if l == nil {
+		return nil
+	}
+	label := HostLabels.Value(upstream)
+
+	l.mu.Lock()
+	paused := time.Until(l.pausedUntil[upstream])
+	if paused <= 0 {
+		delete(l.pausedUntil, upstream)
+	}
+	bucket := l.bucket(upstream, credsKey)
+	l.mu.Unlock()
+
+	if paused > 0 {
+		if paused > l.maxWait {
+			rateLimitWaits.WithLabelValues(label, "limited").Inc()
+			return fmt.Errorf("%w: paused for %s", ErrRateLimited, paused.Round(time.Second))
+		}
+		select {
+		case <-time.After(paused):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if bucket == nil {
+		return nil
+	}
+
+	var err error
+	if l.maxWait > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, l.maxWait)
+		err = bucket.Wait(waitCtx)
+		cancel()
+	} else if !bucket.Allow() {
+		err = ErrRateLimited
+	}
+	rateLimitTokens.WithLabelValues(label).Set(bucket.Tokens())
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		rateLimitWaits.WithLabelValues(label, "limited").Inc()
+		return fmt.Errorf("%w: no tokens within %s", ErrRateLimited, l.maxWait)
+	}
+	rateLimitWaits.WithLabelValues(label, "ok").Inc()
+	return nil
+}
+
+// bucket returns token bucket for upstream, or nil if it is not limited. Should be called with mu held.
+func (l *RateLimiter) bucket(upstream, credsKey string) *rate.Limiter {
+	limit, ok := l.limits[upstream]
+	if !ok {
+		if limit, ok = l.limits["*"]; !ok {
+			return nil
+		}
+	}
+	key := upstream
+	if l.perCreds {
+		key += "|" + credsKey
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		l.evictFull()
+		b = rate.NewLimiter(rate.Limit(limit.RPS), limit.Burst)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// evictFull removes buckets refilled to burst, which are the same as new ones, so that `*` limit does not keep
+// a bucket for every host clients asked for. Should be called with mu held.
+func (l *RateLimiter) evictFull() {
+	for key, b := range l.buckets {
+		if b.Tokens() >= float64(b.Burst()) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Pause stops requests to upstream for the duration, e.g. from 429 Retry-After header
+func (l *RateLimiter) Pause(upstream string, d time.Duration) {
+	if l == nil || d <= 0 {
+		return
+	}
+	until := time.Now().Add(d)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until.After(l.pausedUntil[upstream]) {
+		l.pausedUntil[upstream] = until
+		rateLimitPaused.WithLabelValues(HostLabels.Value(upstream)).Set(float64(until.Unix()))
+	}
+	for host, t := range l.pausedUntil {
+		if time.Now().After(t) {
+			delete(l.pausedUntil, host)
+		}
+	}
+}
+
+// ParseRetryAfter parses Retry-After header value in seconds or http-date form
+func ParseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// Equal returns true if both limiters have the same settings
+func (l *RateLimiter) Equal(other *RateLimiter) bool {
+	if l == nil || other == nil {
+		return l == other
+	}
+	return l.perCreds == other.perCreds && l.maxWait == other.maxWait && maps.Equal(l.limits, other.limits)
+}
@@ -0,0 +1,97 @@
+package upstream
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// defaultRules are applied unless a rule with the same prefix is configured
+var defaultRules = []string{
+	"docker.io=registry-1.docker.io",
+}
+
+// Target is an upstream location to fetch an object from
+type Target struct {
+	Registry   string // Host serving the /v2/ API, e.g. mirror.gcr.io
+	Repository string // Repository on that host, after prefix rewriting
+}
+
+// Rule rewrites a registry[/repository] prefix into an ordered list of upstream prefixes
+type Rule struct {
+	Prefix  string
+	Targets []string
+}
+
+// Rewriter maps a logical registry/repository (as requested by containerd via `ns`)
+// to the upstreams it should be fetched from. Cache keys are not affected.
+type Rewriter struct {
+	rules []Rule // sorted by prefix length, longest first
+}
+
+// ParseRule parses `from=to[,fallback...]`, e.g. `docker.io=mirror.gcr.io,registry-1.docker.io`
+// or `quay.io/foo=harbor.internal/quay-proxy/foo`
+func ParseRule(s string) (Rule, error) {
+	from, to, ok := strings.Cut(s, "=")
+	from = strings.Trim(strings.TrimSpace(from), "/")
+	if !ok || from == "" {
+		return Rule{}, fmt.Errorf("invalid rule `%s`, expected `from=to[,fallback...]`", s)
+	}
+	rule := Rule{Prefix: from}
+	for t := range strings.SplitSeq(to, ",") {
+		t = strings.Trim(strings.TrimSpace(t), "/")
+		if t == "" {
+			return Rule{}, fmt.Errorf("invalid rule `%s`, empty upstream", s)
+		}
+		rule.Targets = append(rule.Targets, t)
+	}
+	return rule, nil
+}
+
+// NewRewriter creates a Rewriter from `from=to[,fallback...]` rules, on top of the default ones
+func NewRewriter(rules []string) (*Rewriter, error) {
+	byPrefix := map[string]Rule{}
+	for _, s := range append(defaultRules, rules...) {
+		rule, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		byPrefix[rule.Prefix] = rule
+	}
+
+	r := &Rewriter{}
+	for _, rule := range byPrefix {
+		r.rules = append(r.rules, rule)
+	}
+	sort.Slice(r.rules, func(i, j int) bool {
+		return len(r.rules[i].Prefix) > len(r.rules[j].Prefix)
+	})
+	return r, nil
+}
+
+// Rules returns configured rules, longest prefix first
+func (r *Rewriter) Rules() []Rule {
+	if r == nil {
+		return nil
+	}
+	return r.rules
+}
+
+// Resolve returns the ordered list of upstreams for registry/repository by longest prefix match.
+// Without a matching rule the object is fetched from the registry itself.
+func (r *Rewriter) Resolve(registry, repository string) []Target {
+	fullPath := registry + "/" + repository
+	for _, rule := range r.Rules() {
+		if fullPath != rule.Prefix && !strings.HasPrefix(fullPath, rule.Prefix+"/") {
+			continue
+		}
+		rest := strings.TrimPrefix(fullPath, rule.Prefix)
+		res := make([]Target, 0, len(rule.Targets))
+		for _, t := range rule.Targets {
+			host, repo, _ := strings.Cut(t+rest, "/")
+			res = append(res, Target{Registry: host, Repository: repo})
+		}
+		return res
+	}
+	return []Target{{Registry: registry, Repository: repository}}
+}
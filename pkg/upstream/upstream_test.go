@@ -0,0 +1,151 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule("docker.io=mirror.gcr.io, registry-1.docker.io")
+	assert.NoError(t, err)
+	assert.Equal(t, Rule{Prefix: "docker.io", Targets: []string{"mirror.gcr.io", "registry-1.docker.io"}}, rule)
+
+	rule, err = ParseRule("quay.io/foo/=harbor.internal/quay-proxy/foo/")
+	assert.NoError(t, err)
+	assert.Equal(t, Rule{Prefix: "quay.io/foo", Targets: []string{"harbor.internal/quay-proxy/foo"}}, rule)
+
+	for _, s := range []string{"docker.io", "=registry-1.docker.io", "docker.io=", "docker.io=a,,b"} {
+		_, err = ParseRule(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	r, err := NewRewriter([]string{
+		"docker.io=mirror.gcr.io,registry-1.docker.io",
+		"k8s.gcr.io=registry.k8s.io",
+		"quay.io/foo=harbor.internal/quay-proxy/foo",
+	})
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		registry   string
+		repository string
+		want       []Target
+	}{
+		{"mirror with fallback", "docker.io", "library/alpine", []Target{
+			{"mirror.gcr.io", "library/alpine"},
+			{"registry-1.docker.io", "library/alpine"},
+		}},
+		{"alias", "k8s.gcr.io", "pause", []Target{{"registry.k8s.io", "pause"}}},
+		{"path prefix", "quay.io", "foo/bar/baz", []Target{{"harbor.internal", "quay-proxy/foo/bar/baz"}}},
+		{"no partial segment match", "quay.io", "foobar/baz", []Target{{"quay.io", "foobar/baz"}}},
+		{"no match", "ghcr.io", "org/repo", []Target{{"ghcr.io", "org/repo"}}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, r.Resolve(tc.registry, tc.repository))
+		})
+	}
+}
+
+func TestDefaultRules(t *testing.T) {
+	r, err := NewRewriter(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Target{{"registry-1.docker.io", "library/alpine"}}, r.Resolve("docker.io", "library/alpine"))
+
+	var empty *Rewriter
+	assert.Equal(t, []Target{{"docker.io", "library/alpine"}}, empty.Resolve("docker.io", "library/alpine"))
+}
+
+func TestHealth(t *testing.T) {
+	h := NewHealth(2, time.Hour)
+	targets := []Target{{"mirror.gcr.io", "library/alpine"}, {"registry-1.docker.io", "library/alpine"}}
+
+	assert.False(t, h.Failure("mirror.gcr.io"))
+	h.Success("mirror.gcr.io")
+	assert.False(t, h.Failure("mirror.gcr.io"))
+	assert.Equal(t, targets, h.Filter(targets))
+
+	assert.True(t, h.Failure("mirror.gcr.io"))
+	assert.False(t, h.Available("mirror.gcr.io"))
+	assert.Equal(t, targets[1:], h.Filter(targets))
+
+	// never skip all of them
+	assert.True(t, h.Failure("registry-1.docker.io") || h.Failure("registry-1.docker.io"))
+	assert.Equal(t, targets, h.Filter(targets))
+
+	var disabled *Health
+	assert.False(t, disabled.Failure("mirror.gcr.io"))
+	assert.Equal(t, targets, disabled.Filter(targets))
+}
+
+func TestParseLimit(t *testing.T) {
+	l, err := ParseLimit("registry-1.docker.io=0.5:10")
+	assert.NoError(t, err)
+	assert.Equal(t, Limit{Upstream: "registry-1.docker.io", RPS: 0.5, Burst: 10}, l)
+
+	l, err = ParseLimit("*=2")
+	assert.NoError(t, err)
+	assert.Equal(t, Limit{Upstream: "*", RPS: 2, Burst: 1}, l)
+
+	for _, s := range []string{"registry-1.docker.io", "=1", "ghcr.io=0", "ghcr.io=x", "ghcr.io=1:0"} {
+		_, err = ParseLimit(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter([]Limit{{Upstream: "registry-1.docker.io", RPS: 0.001, Burst: 1}}, true, 10*time.Millisecond)
+	ctx := context.Background()
+
+	assert.NoError(t, l.Wait(ctx, "registry-1.docker.io", "a"))
+	assert.ErrorIs(t, l.Wait(ctx, "registry-1.docker.io", "a"), ErrRateLimited)
+	// separate bucket per creds
+	assert.NoError(t, l.Wait(ctx, "registry-1.docker.io", "b"))
+	// not limited
+	assert.NoError(t, l.Wait(ctx, "ghcr.io", ""))
+
+	l.Pause("ghcr.io", time.Hour)
+	assert.ErrorIs(t, l.Wait(ctx, "ghcr.io", ""), ErrRateLimited)
+
+	var disabled *RateLimiter
+	assert.NoError(t, disabled.Wait(ctx, "ghcr.io", ""))
+
+	// no wait, only available tokens are used
+	l = NewRateLimiter([]Limit{{Upstream: "ghcr.io", RPS: 0.001, Burst: 1}}, false, 0)
+	assert.NoError(t, l.Wait(ctx, "ghcr.io", ""))
+	assert.ErrorIs(t, l.Wait(ctx, "ghcr.io", ""), ErrRateLimited)
+
+	// client cancel is not a rate limit
+	l = NewRateLimiter([]Limit{{Upstream: "ghcr.io", RPS: 0.001, Burst: 1}}, false, time.Hour)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equal(t, context.Canceled, l.Wait(canceled, "ghcr.io", ""))
+
+	// idle buckets of `*` limit are evicted
+	l = NewRateLimiter([]Limit{{Upstream: "*", RPS: 1000, Burst: 1}}, false, 10*time.Millisecond)
+	assert.NoError(t, l.Wait(ctx, "a.example.com", ""))
+	time.Sleep(5 * time.Millisecond)
+	assert.NoError(t, l.Wait(ctx, "b.example.com", ""))
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestLabelSet(t *testing.T) {
+	labels := &LabelSet{Max: 2}
+	assert.Equal(t, "a", labels.Value("a"))
+	assert.Equal(t, "b", labels.Value("b"))
+	assert.Equal(t, "other", labels.Value("c"))
+	assert.Equal(t, "a", labels.Value("a"))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 30*time.Second, ParseRetryAfter("30"))
+	assert.Equal(t, time.Duration(0), ParseRetryAfter(""))
+	assert.InDelta(t, time.Minute, ParseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)), float64(2*time.Second))
+}
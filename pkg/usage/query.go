@@ -0,0 +1,138 @@
+package usage
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+)
+
+// Image is usage of a registry/repository
+type Image struct {
+	Image      string    `json:"image"`
+	Pulls      int64     `json:"pulls"` // cache hits of manifests not referenced by an index
+	Size       int64     `json:"size"`  // of manifests and referenced blobs, shared blobs are counted for each image
+	LastAccess time.Time `json:"lastAccess"`
+}
+
+// TopImages returns n images with most pulls, or largest size when by is `size`
+func TopImages(entries map[string]*Entry, by string, n int) []Image {
+	images := map[string]*Image{}
+	get := func(name string) *Image {
+		img, ok := images[name]
+		if !ok {
+			img = &Image{Image: name}
+			images[name] = img
+		}
+		return img
+	}
+	for _, e := range entries {
+		if e.Type == model.ObjectTypeManifest {
+			img := get(e.Registry + "/" + e.Repository)
+			img.Size += e.Size
+			if len(e.Manifests) == 0 {
+				img.Pulls += e.Hits
+			}
+			if e.LastAccess.After(img.LastAccess) {
+				img.LastAccess = e.LastAccess
+			}
+			continue
+		}
+		seen := map[string]bool{}
+		for _, m := range e.Manifests {
+			name := imageOf(m)
+			if name != "" && !seen[name] {
+				seen[name] = true
+				get(name).Size += e.Size
+			}
+		}
+	}
+
+	res := make([]Image, 0, len(images))
+	for _, img := range images {
+		res = append(res, *img)
+	}
+	slices.SortFunc(res, func(a, b Image) int {
+		if by == "size" {
+			return cmp.Or(cmp.Compare(b.Size, a.Size), cmp.Compare(a.Image, b.Image))
+		}
+		return cmp.Or(cmp.Compare(b.Pulls, a.Pulls), cmp.Compare(a.Image, b.Image))
+	})
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// imageOf returns registry/repository of manifest key
+func imageOf(key string) string {
+	object, ok := cache.CacheNameToObject(key)
+	if !ok || object.Type != model.ObjectTypeManifest {
+		return ""
+	}
+	return object.Registry + "/" + object.Repository
+}
+
+// Object is usage of a cached object
+type Object struct {
+	Key string `json:"key"`
+	*Entry
+}
+
+// UnusedSince returns objects not accessed since the time, oldest first
+func UnusedSince(entries map[string]*Entry, since time.Time) []Object {
+	var res []Object
+	for k, e := range entries {
+		if e.LastAccess.Before(since) {
+			res = append(res, Object{Key: k, Entry: e})
+		}
+	}
+	slices.SortFunc(res, func(a, b Object) int {
+		return cmp.Or(a.LastAccess.Compare(b.LastAccess), cmp.Compare(a.Key, b.Key))
+	})
+	return res
+}
+
+// Registry is usage of a registry, blobs are accounted to the registry they were first requested from
+type Registry struct {
+	Registry string `json:"registry"`
+	Objects  int    `json:"objects"`
+	Size     int64  `json:"size"`
+	Hits     int64  `json:"hits"`
+}
+
+// Registries returns usage by registry, largest first
+func Registries(entries map[string]*Entry) []Registry {
+	registries := map[string]*Registry{}
+	for _, e := range entries {
+		name := e.Registry
+		if name == "" && len(e.Manifests) != 0 {
+			// blobs filled from the cache are only known by referencing manifests
+			if object, ok := cache.CacheNameToObject(e.Manifests[0]); ok {
+				name = object.Registry
+			}
+		}
+		if name == "" {
+			name = "unknown"
+		}
+		r, ok := registries[name]
+		if !ok {
+			r = &Registry{Registry: name}
+			registries[name] = r
+		}
+		r.Objects++
+		r.Size += e.Size
+		r.Hits += e.Hits
+	}
+
+	res := make([]Registry, 0, len(registries))
+	for _, r := range registries {
+		res = append(res, *r)
+	}
+	slices.SortFunc(res, func(a, b Registry) int {
+		return cmp.Or(cmp.Compare(b.Size, a.Size), cmp.Compare(a.Registry, b.Registry))
+	})
+	return res
+}
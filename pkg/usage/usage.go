@@ -0,0 +1,369 @@
+package usage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+)
+
+// metaPrefix of snapshot files in the cache, one per replica
+const metaPrefix = "usage/"
+
+// staleAfter is age of snapshots of gone replicas (like Deployment pods) to be folded into own one
+const staleAfter = 24 * time.Hour
+
+// scanInterval of walking the cache, to add objects not seen yet and prune deleted ones
+const scanInterval = 24 * time.Hour
+
+var ErrNotLoaded = errors.New("usage index is not loaded yet")
+
+// Entry is usage of a cached object, by its cache key
+type Entry struct {
+	Registry   string           `json:"registry,omitempty"` // for blobs, the one it was first requested from
+	Repository string           `json:"repository,omitempty"`
+	Ref        string           `json:"ref"`
+	Type       model.ObjectType `json:"type"`
+	Size       int64            `json:"size"`
+	Hits       int64            `json:"hits"`
+	LastAccess time.Time        `json:"lastAccess"`
+	Manifests  []string         `json:"manifests,omitempty"` // keys of manifests referencing the object, filled by Entries
+}
+
+type snapshot struct {
+	Entries map[string]*Entry   `json:"entries"`
+	Refs    map[string][]string `json:"refs,omitempty"` // object key to keys of manifests referencing it
+}
+
+func newSnapshot() snapshot {
+	return snapshot{Entries: map[string]*Entry{}, Refs: map[string][]string{}}
+}
+
+// merge adds o to s, summing hits and keeping the latest access
+func (s snapshot) merge(o snapshot) {
+	for k, e := range o.Entries {
+		cur, ok := s.Entries[k]
+		if !ok {
+			c := *e
+			s.Entries[k] = &c
+			continue
+		}
+		cur.Hits += e.Hits
+		cur.Size = max(cur.Size, e.Size)
+		if e.LastAccess.After(cur.LastAccess) {
+			cur.LastAccess = e.LastAccess
+		}
+		if cur.Registry == "" {
+			cur.Registry, cur.Repository = e.Registry, e.Repository
+		}
+	}
+	for k, parents := range o.Refs {
+		for _, p := range parents {
+			if !slices.Contains(s.Refs[k], p) {
+				s.Refs[k] = append(s.Refs[k], p)
+			}
+		}
+	}
+}
+
+// Index records usage of cached objects in memory, and periodically saves it as a snapshot file of this
+// replica to the cache backend. Queries merge snapshots of all replicas sharing the backend.
+type Index struct {
+	store   cache.Store
+	replica string
+	logger  *slog.Logger
+
+	loaded atomic.Bool // own snapshot is merged
+	mu     sync.Mutex
+	data   snapshot
+	dirty  bool
+}
+
+func New(store cache.Store, replica string, logger *slog.Logger) *Index {
+	if replica == "" {
+		replica = "default"
+	}
+	return &Index{store: store, replica: replica, logger: logger, data: newSnapshot()}
+}
+
+func (i *Index) name() string {
+	return metaPrefix + i.replica + ".json"
+}
+
+// Access records object served from cache (hit) or stored to it. HEAD hits should update last access only, as
+// containerd sends HEAD before GET of each manifest.
+func (i *Index) Access(object *model.ObjectIdentifier, size int64, hit bool) {
+	key := cache.ObjectToCacheName(object)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	e, ok := i.data.Entries[key]
+	if !ok {
+		e = &Entry{Registry: object.Registry, Repository: object.Repository, Ref: object.Ref, Type: object.Type}
+		i.data.Entries[key] = e
+	}
+	if hit {
+		e.Hits++
+	}
+	e.Size = size
+	e.LastAccess = time.Now()
+	i.dirty = true
+}
+
+// Stored records object saved to cache, with references of the manifest body
+func (i *Index) Stored(object *model.ObjectIdentifier, size int64, body []byte) {
+	i.Access(object, size, false)
+	if object.Type != model.ObjectTypeManifest {
+		return
+	}
+	refs, err := model.ManifestReferences(*object, body)
+	if err != nil {
+		i.logger.Debug("Could not parse manifest for usage index", "error", err)
+		return
+	}
+	i.references(object, refs)
+}
+
+func (i *Index) references(object *model.ObjectIdentifier, refs []model.ObjectIdentifier) {
+	parent := cache.ObjectToCacheName(object)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, r := range refs {
+		key := cache.ObjectToCacheName(&r)
+		if !slices.Contains(i.data.Refs[key], parent) {
+			i.data.Refs[key] = append(i.data.Refs[key], parent)
+			i.dirty = true
+		}
+	}
+}
+
+// Run loads the snapshot of this replica and saves it every interval until ctx is done. The index is synced with
+// objects in the cache at start and every scanInterval, using their modification time as access of the new ones.
+// Loading is retried every interval, as saving before that would overwrite the previous snapshot.
+func (i *Index) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		err := i.load(ctx)
+		if err == nil {
+			break
+		}
+		i.logger.Warn("Could not load usage index", "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+	i.scan(ctx)
+
+	scan := time.NewTicker(scanInterval)
+	defer scan.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-scan.C:
+			i.scan(ctx)
+		case <-t.C:
+			if err := i.Flush(ctx); err != nil {
+				i.logger.Warn("Could not save usage index", "error", err)
+			}
+		}
+	}
+}
+
+// load merges own snapshot and the stale ones of other replicas.
+// Only failure to read own snapshot is an error, folding of others is retried on the next start.
+func (i *Index) load(ctx context.Context) error {
+	files, err := i.store.ListMeta(ctx, metaPrefix)
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(files, func(f cache.ObjectInfo) bool { return f.Key == i.name() }) {
+		s, err := i.read(ctx, i.name())
+		if err != nil {
+			return err
+		}
+		i.mu.Lock()
+		i.data.merge(s)
+		i.mu.Unlock()
+	}
+	for _, f := range files {
+		if f.Key == i.name() || time.Since(f.ModTime) < staleAfter {
+			continue
+		}
+		s, err := i.read(ctx, f.Key)
+		if err == nil {
+			// another replica starting at the same time could fold it too, counting hits twice
+			err = i.store.DeleteMeta(ctx, f.Key)
+		}
+		if err != nil {
+			i.logger.Warn("Could not fold usage index of gone replica", "file", f.Key, "error", err)
+			continue
+		}
+		i.mu.Lock()
+		i.data.merge(s)
+		i.dirty = true
+		i.mu.Unlock()
+		i.logger.Info("Folded usage index of gone replica", "file", f.Key, "modified", f.ModTime)
+	}
+	i.loaded.Store(true)
+	return nil
+}
+
+func (i *Index) read(ctx context.Context, name string) (snapshot, error) {
+	s := newSnapshot()
+	data, err := i.store.ReadMeta(ctx, name)
+	if err != nil {
+		return s, err
+	}
+	return s, json.Unmarshal(data, &s)
+}
+
+// scan walks the cache to add objects missing in the index, and to prune entries of the ones deleted not via the
+// index (by external cleanup, or GC of another replica). Entries accessed during the walk are kept.
+func (i *Index) scan(ctx context.Context) {
+	start := time.Now()
+	seen := map[string]bool{}
+	var added int
+	err := i.store.Walk(ctx, func(o cache.ObjectInfo) error {
+		if o.Orphan {
+			return nil
+		}
+		seen[o.Key] = true
+		i.mu.Lock()
+		e, ok := i.data.Entries[o.Key]
+		if !ok {
+			e = &Entry{Registry: o.Registry, Repository: o.Repository, Ref: o.Ref, Type: o.Type, LastAccess: o.ModTime}
+			i.data.Entries[o.Key] = e
+			added++
+		}
+		if !ok || e.Size != o.Size {
+			e.Size = o.Size
+			i.dirty = true
+		}
+		i.mu.Unlock()
+		if !ok && o.Type == model.ObjectTypeManifest {
+			if err := i.backfillReferences(ctx, &o.ObjectIdentifier); err != nil {
+				i.logger.Debug("Could not read manifest for usage index", "key", o.Key, "error", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// partial walk could not tell deleted objects
+		i.logger.Warn("Could not sync usage index with cache", "error", err)
+		return
+	}
+
+	var pruned []string
+	i.mu.Lock()
+	for k, e := range i.data.Entries {
+		if !seen[k] && e.LastAccess.Before(start) {
+			pruned = append(pruned, k)
+		}
+	}
+	i.mu.Unlock()
+	i.Remove(pruned...)
+	i.logger.Info("Synced usage index with cache", "added", added, "pruned", len(pruned), "duration", time.Since(start))
+}
+
+func (i *Index) backfillReferences(ctx context.Context, object *model.ObjectIdentifier) error {
+	body, err := cache.ReadObject(ctx, i.store, object, model.MaxManifestSize)
+	if err != nil || body == nil {
+		return err
+	}
+	refs, err := model.ManifestReferences(*object, body)
+	if err != nil {
+		return err
+	}
+	i.references(object, refs)
+	return nil
+}
+
+// Remove drops deleted objects from this replica, including them as referencing manifests
+func (i *Index) Remove(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	removed := map[string]bool{}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, k := range keys {
+		delete(i.data.Entries, k)
+		delete(i.data.Refs, k)
+		removed[k] = true
+	}
+	for k, parents := range i.data.Refs {
+		if parents = slices.DeleteFunc(parents, func(p string) bool { return removed[p] }); len(parents) == 0 {
+			delete(i.data.Refs, k)
+		} else {
+			i.data.Refs[k] = parents
+		}
+	}
+	i.dirty = true
+}
+
+// Flush saves snapshot of this replica if it has changed and the previous one is loaded
+func (i *Index) Flush(ctx context.Context) error {
+	if !i.loaded.Load() {
+		return nil
+	}
+	i.mu.Lock()
+	if !i.dirty {
+		i.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(i.data)
+	i.dirty = false
+	i.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = i.store.WriteMeta(ctx, i.name(), data); err != nil {
+		i.mu.Lock()
+		i.dirty = true
+		i.mu.Unlock()
+	}
+	return err
+}
+
+// Entries returns usage merged from all replicas by object key, with referencing manifests
+func (i *Index) Entries(ctx context.Context) (map[string]*Entry, error) {
+	if !i.loaded.Load() {
+		return nil, ErrNotLoaded
+	}
+	res := newSnapshot()
+	i.mu.Lock()
+	res.merge(i.data)
+	i.mu.Unlock()
+
+	files, err := i.store.ListMeta(ctx, metaPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.Key == i.name() {
+			continue
+		}
+		s, err := i.read(ctx, f.Key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // folded meanwhile
+		} else if err != nil {
+			return nil, err
+		}
+		res.merge(s)
+	}
+	for k, e := range res.Entries {
+		e.Manifests = slices.Sorted(slices.Values(res.Refs[k]))
+	}
+	return res.Entries, nil
+}
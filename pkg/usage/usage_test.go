@@ -0,0 +1,115 @@
+package usage
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sepich/containerd-registry-cache/pkg/cache"
+	"github.com/sepich/containerd-registry-cache/pkg/cache/cachetest"
+	"github.com/sepich/containerd-registry-cache/pkg/model"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	imageDigest  = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	configDigest = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+	layerDigest  = "sha256:4444444444444444444444444444444444444444444444444444444444444444"
+)
+
+var (
+	tag    = model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: "3.20", Type: model.ObjectTypeManifest}
+	image  = model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: imageDigest, Type: model.ObjectTypeManifest}
+	config = model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: configDigest, Type: model.ObjectTypeBlob}
+	layer  = model.ObjectIdentifier{Registry: "docker.io", Repository: "library/alpine", Ref: layerDigest, Type: model.ObjectTypeBlob}
+	pause  = model.ObjectIdentifier{Registry: "registry.k8s.io", Repository: "pause", Ref: "3.10", Type: model.ObjectTypeManifest}
+
+	indexBody = `{"manifests":[{"digest":"` + imageDigest + `"}]}`
+	imageBody = `{"config":{"digest":"` + configDigest + `"},"layers":[{"digest":"` + layerDigest + `"}]}`
+)
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	c := &cache.FileCache{CacheDirectory: t.TempDir()}
+	logger := slog.New(slog.DiscardHandler)
+
+	a := New(c, "a", logger)
+	_, err := a.Entries(ctx)
+	assert.ErrorIs(t, err, ErrNotLoaded)
+	assert.NoError(t, a.load(ctx))
+	a.Stored(&tag, int64(len(indexBody)), []byte(indexBody))
+	a.Stored(&image, int64(len(imageBody)), []byte(imageBody))
+	a.Stored(&config, 10, nil)
+	a.Stored(&layer, 1000, nil)
+	a.Access(&tag, int64(len(indexBody)), true)
+	a.Access(&layer, 1000, true)
+	assert.NoError(t, a.Flush(ctx))
+
+	b := New(c, "b", logger)
+	assert.NoError(t, b.load(ctx))
+	b.Access(&tag, int64(len(indexBody)), true)
+	b.Access(&pause, 5, true)
+	entries, err := b.Entries(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 5)
+	assert.Equal(t, int64(2), entries[cache.ObjectToCacheName(&tag)].Hits, "merged from both replicas")
+	assert.Equal(t, []string{cache.ObjectToCacheName(&image)}, entries["blobs/44/"+layerDigest[7:]].Manifests)
+
+	top := TopImages(entries, "", 10)
+	assert.Equal(t, []string{"docker.io/library/alpine", "registry.k8s.io/pause"}, []string{top[0].Image, top[1].Image})
+	assert.Equal(t, int64(2), top[0].Pulls, "platform manifest is not counted as a pull")
+	assert.Equal(t, int64(len(indexBody)+len(imageBody)+1010), top[0].Size)
+	assert.Len(t, TopImages(entries, "size", 1), 1)
+
+	entries["registry.k8s.io/pause/3.10"].LastAccess = time.Now().AddDate(0, 0, -40)
+	unused := UnusedSince(entries, time.Now().AddDate(0, 0, -30))
+	assert.Len(t, unused, 1)
+	assert.Equal(t, "registry.k8s.io/pause/3.10", unused[0].Key)
+
+	assert.Equal(t, []Registry{
+		{Registry: "docker.io", Objects: 4, Size: int64(len(indexBody)+len(imageBody)) + 1010, Hits: 2 + 1},
+		{Registry: "registry.k8s.io", Objects: 1, Size: 5, Hits: 1},
+	}, Registries(entries))
+}
+
+func TestScan(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c := &cache.FileCache{CacheDirectory: dir}
+	cachetest.Put(t, c, tag, indexBody, "", "")
+	cachetest.Put(t, c, image, imageBody, "", "")
+	cachetest.Put(t, c, layer, "layer", "", "")
+
+	idx := New(c, "a", slog.New(slog.DiscardHandler))
+	assert.NoError(t, idx.load(ctx))
+	idx.scan(ctx)
+	entries, err := idx.Entries(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, int64(5), entries["blobs/44/"+layerDigest[7:]].Size)
+	assert.False(t, entries["blobs/44/"+layerDigest[7:]].LastAccess.IsZero())
+	assert.Equal(t, []Registry{{Registry: "docker.io", Objects: 3, Size: int64(len(indexBody)+len(imageBody)) + 5}}, Registries(entries))
+	assert.Equal(t, []string{cache.ObjectToCacheName(&image)}, entries["blobs/44/"+layerDigest[7:]].Manifests)
+
+	// deleted not via the index are pruned, unless accessed during the scan
+	assert.NoError(t, c.Delete(ctx, cache.ObjectToCacheName(&image)))
+	assert.NoError(t, c.Delete(ctx, cache.ObjectToCacheName(&layer)))
+	idx.Access(&layer, 5, true)
+	idx.data.Entries[cache.ObjectToCacheName(&layer)].LastAccess = time.Now().Add(time.Minute)
+	idx.scan(ctx)
+	assert.Len(t, idx.data.Entries, 2)
+	assert.NotContains(t, idx.data.Entries, cache.ObjectToCacheName(&image))
+	assert.Empty(t, idx.data.Refs["blobs/44/"+layerDigest[7:]], "deleted manifest does not reference")
+
+	// stale snapshot of a gone replica is folded
+	assert.NoError(t, idx.Flush(ctx))
+	old := time.Now().Add(-2 * staleAfter)
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "_meta", "usage", "a.json"), old, old))
+	next := New(c, "b", slog.New(slog.DiscardHandler))
+	assert.NoError(t, next.load(ctx))
+	assert.NoFileExists(t, filepath.Join(dir, "_meta", "usage", "a.json"))
+	assert.Len(t, next.data.Entries, 2)
+}